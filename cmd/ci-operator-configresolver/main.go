@@ -27,12 +27,15 @@ import (
 type options struct {
 	configPath             string
 	registryPath           string
+	registryLayers         flagutil.Strings
 	logLevel               string
 	address                string
 	port                   int
 	uiAddress              string
 	uiPort                 int
 	gracePeriod            time.Duration
+	cycle                  time.Duration
+	watchChanges           bool
 	validateOnly           bool
 	flatRegistry           bool
 	instrumentationOptions flagutil.InstrumentationOptions
@@ -47,13 +50,15 @@ func gatherOptions() (options, error) {
 	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	fs.StringVar(&o.configPath, "config", "", "Path to config dirs")
 	fs.StringVar(&o.registryPath, "registry", "", "Path to registry dirs")
+	fs.Var(&o.registryLayers, "registry-layer", "Path to the dirs of a registry layered over the --registry, like a private registry. Can be passed multiple times; later layers take precedence.")
 	fs.StringVar(&o.logLevel, "log-level", "info", "Level at which to log output.")
 	fs.StringVar(&o.address, "address", ":8080", "DEPRECATED: Address to run server on")
 	fs.StringVar(&o.uiAddress, "ui-address", ":8082", "DEPRECATED: Address to run the registry UI on")
 	fs.IntVar(&o.port, "port", 8080, "Port to run server on")
 	fs.IntVar(&o.uiPort, "ui-port", 8082, "Port to run the registry UI on")
 	fs.DurationVar(&o.gracePeriod, "gracePeriod", time.Second*10, "Grace period for server shutdown")
-	_ = fs.Duration("cycle", time.Minute*2, "Legacy flag kept for compatibility. Does nothing")
+	fs.DurationVar(&o.cycle, "cycle", time.Minute*2, "Interval at which the configs and the registry are fully reloaded when --watch-changes is set. Disabled when zero.")
+	fs.BoolVar(&o.watchChanges, "watch-changes", false, "Reload only the configs and registry files that change instead of everything.")
 	fs.BoolVar(&o.validateOnly, "validate-only", false, "Load the config and registry, validate them and exit.")
 	fs.BoolVar(&o.flatRegistry, "flat-registry", false, "Disable directory structure based registry validation")
 	o.instrumentationOptions.AddFlags(fs)
@@ -86,26 +91,20 @@ func validateOptions(o options) error {
 		}
 		return fmt.Errorf("Error getting stat info for --registry directory: %w", err)
 	}
+	for _, layer := range o.registryLayers.Strings() {
+		if _, err := os.Stat(layer); err != nil {
+			return fmt.Errorf("--registry-layer %s is not accessible: %w", layer, err)
+		}
+	}
+	if o.cycle < 0 {
+		return errors.New("--cycle must not be negative")
+	}
 	if o.validateOnly && o.flatRegistry {
 		return errors.New("--validate-only and --flat-registry flags cannot be set simultaneously")
 	}
 	return o.instrumentationOptions.Validate(false)
 }
 
-func getConfigGeneration(agent agents.ConfigAgent) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, "%d", agent.GetGeneration())
-	}
-}
-
-func getRegistryGeneration(agent agents.RegistryAgent) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, "%d", agent.GetGeneration())
-	}
-}
-
 // l and v keep the tree legible
 func l(fragment string, children ...simplifypath.Node) simplifypath.Node {
 	return simplifypath.L(fragment, children...)
@@ -123,12 +122,18 @@ func main() {
 	level, _ := logrus.ParseLevel(o.logLevel)
 	logrus.SetLevel(level)
 
-	configAgent, err := agents.NewConfigAgent(o.configPath, agents.WithConfigMetrics(configresolverMetrics.ErrorRate))
+	configOpts := []agents.ConfigAgentOption{agents.WithConfigMetrics(configresolverMetrics.ErrorRate)}
+	registryOpts := []agents.RegistryAgentOption{agents.WithRegistryMetrics(configresolverMetrics.ErrorRate), agents.WithRegistryFlat(o.flatRegistry), agents.WithRegistryLayers(o.registryLayers.Strings()...)}
+	if o.watchChanges {
+		configOpts = append(configOpts, agents.WithConfigWatch(o.cycle))
+		registryOpts = append(registryOpts, agents.WithRegistryWatch(o.cycle))
+	}
+	configAgent, err := agents.NewConfigAgent(o.configPath, configOpts...)
 	if err != nil {
 		logrus.Fatalf("Failed to get config agent: %v", err)
 	}
 
-	registryAgent, err := agents.NewRegistryAgent(o.registryPath, agents.WithRegistryMetrics(configresolverMetrics.ErrorRate), agents.WithRegistryFlat(o.flatRegistry))
+	registryAgent, err := agents.NewRegistryAgent(o.registryPath, registryOpts...)
 	if err != nil {
 		logrus.Fatalf("Failed to get registry agent: %v", err)
 	}
@@ -143,6 +148,8 @@ func main() {
 		l("resolve"),
 		l("configGeneration"),
 		l("registryGeneration"),
+		l("configs"),
+		l("registry"),
 	))
 
 	uisimplifier := simplifypath.NewSimplifier(l("", // shadow element mimicing the root
@@ -166,8 +173,10 @@ func main() {
 	http.HandleFunc("/config", handler(registryserver.ResolveConfig(configAgent, registryAgent, configresolverMetrics)).ServeHTTP)
 	http.HandleFunc("/configWithInjectedTest", handler(registryserver.ResolveConfigWithInjectedTest(configAgent, registryAgent, configresolverMetrics)).ServeHTTP)
 	http.HandleFunc("/resolve", handler(registryserver.ResolveLiteralConfig(registryAgent, configresolverMetrics)).ServeHTTP)
-	http.HandleFunc("/configGeneration", handler(getConfigGeneration(configAgent)).ServeHTTP)
-	http.HandleFunc("/registryGeneration", handler(getRegistryGeneration(registryAgent)).ServeHTTP)
+	http.HandleFunc("/configGeneration", handler(agents.ServeConfigGeneration(configAgent)).ServeHTTP)
+	http.HandleFunc("/registryGeneration", handler(agents.ServeRegistryGeneration(registryAgent)).ServeHTTP)
+	http.HandleFunc("/configs", handler(agents.ServeConfigs(configAgent, configresolverMetrics)).ServeHTTP)
+	http.HandleFunc("/registry", handler(agents.ServeRegistry(registryAgent, configresolverMetrics)).ServeHTTP)
 	http.HandleFunc("/readyz", func(_ http.ResponseWriter, _ *http.Request) {})
 	interrupts.ListenAndServe(&http.Server{Addr: ":" + strconv.Itoa(o.port)}, o.gracePeriod)
 	uiServer := &http.Server{
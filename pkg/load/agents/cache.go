@@ -0,0 +1,30 @@
+package agents
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/openshift/ci-tools/pkg/load"
+)
+
+var parseCacheMetric = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "configresolver_parse_cache_lookups_total",
+		Help: "lookups of parsed files in the parse cache by kind of file and result",
+	},
+	[]string{"kind", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(parseCacheMetric)
+}
+
+// newParseCache returns a cache for parsed files that counts its lookups
+func newParseCache() *load.ParseCache {
+	return load.NewParseCache(func(kind string, hit bool) {
+		result := "miss"
+		if hit {
+			result = "hit"
+		}
+		parseCacheMetric.With(prometheus.Labels{"kind": kind, "result": result}).Inc()
+	})
+}
@@ -0,0 +1,90 @@
+package agents
+
+import (
+	"fmt"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"github.com/openshift/ci-tools/pkg/api"
+	"github.com/openshift/ci-tools/pkg/registry"
+)
+
+// componentIndexName is the name of the index from the registry components to
+// the configs that use them, which config agents add when it is first used
+const componentIndexName = "registry-components"
+
+// componentIndexKey returns the key of a component in the component index,
+// which names it by its kind and name like "workflow/ipi"
+func componentIndexKey(name string, kind registry.Type) string {
+	return kind.String() + "/" + name
+}
+
+// indexConfigsByComponent indexes a config by the references, chains and
+// workflows that its multi-stage tests use directly
+func indexConfigsByComponent(config api.ReleaseBuildConfiguration) []string {
+	keys := sets.NewString()
+	for _, test := range config.Tests {
+		multiStage := test.MultiStageTestConfiguration
+		if multiStage == nil {
+			continue
+		}
+		if multiStage.Workflow != nil {
+			keys.Insert(componentIndexKey(*multiStage.Workflow, registry.Workflow))
+		}
+		for _, steps := range [][]api.TestStep{multiStage.Pre, multiStage.Test, multiStage.Post} {
+			for _, step := range steps {
+				switch {
+				case step.Reference != nil:
+					keys.Insert(componentIndexKey(*step.Reference, registry.Reference))
+				case step.Chain != nil:
+					keys.Insert(componentIndexKey(*step.Chain, registry.Chain))
+				}
+			}
+		}
+	}
+	return keys.List()
+}
+
+// GetConfigsUsingComponent returns the configs with tests that directly use
+// the reference, chain or workflow with the given name, sorted by their
+// metadata. Configs that only use the component through other components are
+// not included; RegistryAgent.WhoReferences finds those components.
+func (a *configAgent) GetConfigsUsingComponent(name string, kind registry.Type) ([]*api.ReleaseBuildConfiguration, error) {
+	switch kind {
+	case registry.Reference, registry.Chain, registry.Workflow:
+	default:
+		return nil, fmt.Errorf("unknown registry component type %s", kind)
+	}
+	if err := a.addComponentIndex(); err != nil {
+		return nil, err
+	}
+	a.lock.RLock()
+	configs := append([]*api.ReleaseBuildConfiguration(nil), a.indexes[componentIndexName][componentIndexKey(name, kind)]...)
+	a.lock.RUnlock()
+	sort.Slice(configs, func(i, j int) bool {
+		return configs[i].Metadata.AsString() < configs[j].Metadata.AsString()
+	})
+	return configs, nil
+}
+
+// addComponentIndex adds the component index unless it was added already, so
+// that agents that never use it do not build it on every reload. Unlike
+// AddIndex, it builds the index from the loaded configs instead of reloading
+// them.
+func (a *configAgent) addComponentIndex() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, exists := a.indexFuncs[componentIndexName]; exists {
+		return nil
+	}
+	if a.indexFuncs == nil {
+		a.indexFuncs = map[string]IndexFn{}
+	}
+	if a.indexes == nil {
+		a.indexes = map[string]configIndex{}
+	}
+	a.indexFuncs[componentIndexName] = indexConfigsByComponent
+	a.indexes[componentIndexName] = a.buildIndex(indexConfigsByComponent)
+	return nil
+}
@@ -4,15 +4,19 @@ import (
 	"fmt"
 	"reflect"
 	"regexp"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
 
 	"github.com/openshift/ci-tools/pkg/api"
 	"github.com/openshift/ci-tools/pkg/load"
 	"github.com/openshift/ci-tools/pkg/prowgen"
+	"github.com/openshift/ci-tools/pkg/registry"
+	"github.com/openshift/ci-tools/pkg/validation"
 )
 
 type IndexDelta struct {
@@ -21,6 +25,15 @@ type IndexDelta struct {
 	Removed  []*api.ReleaseBuildConfiguration
 }
 
+// ConfigChange summarizes the changes to the configs in one reload of a ConfigAgent
+type ConfigChange struct {
+	// Generation is the generation of the agent after the reload
+	Generation int
+	Added      []api.Metadata
+	Changed    []api.Metadata
+	Removed    []api.Metadata
+}
+
 // ConfigAgent is an interface that can load configs from disk into
 // memory and retrieve them when provided with a config.Info.
 type ConfigAgent interface {
@@ -28,10 +41,36 @@ type ConfigAgent interface {
 	// allowing for regex matching on branch names.
 	GetMatchingConfig(metadata api.Metadata) (api.ReleaseBuildConfiguration, error)
 	GetAll() load.ByOrgRepo
+	// Search returns the metadata of all configs whose fields match the fields
+	// set in the query, best matches first. Fields match if they are equal,
+	// start with or contain the queried value, or contain its characters in
+	// order, ignoring case.
+	Search(query api.Metadata) []api.Metadata
 	GetGeneration() int
 	AddIndex(indexName string, indexFunc IndexFn) error
 	GetFromIndex(indexName string, indexKey string) ([]*api.ReleaseBuildConfiguration, error)
 	SubscribeToIndexChanges(indexName string) (<-chan IndexDelta, error)
+	// SetOverlay makes the agent use content instead of the file at path, which
+	// does not need to exist on disk, until the overlay is removed again.
+	SetOverlay(path string, content []byte) error
+	// RemoveOverlay makes the agent use the file at path from disk again.
+	RemoveOverlay(path string) error
+	// Subscribe registers a callback that is called with a summary of the changes
+	// after every reload of the agent. Callbacks are called sequentially after the
+	// reload finished and should not block.
+	Subscribe(callback func(ConfigChange))
+	// ReloadPaths reloads the configs at or below the given paths, which may have
+	// been added, changed or removed, without reloading any other configs.
+	ReloadPaths(paths []string) error
+	// Node returns the parsed YAML document of the file at path, which holds
+	// the line and column of every key and value in the file.
+	Node(path string) (*yaml.Node, error)
+	// LoadErrors returns the errors of the files that an agent created with
+	// WithConfigPartialLoad failed to load, sorted by path.
+	LoadErrors() []*load.FileError
+	// GetConfigsUsingComponent returns the configs with tests that directly
+	// use the registry reference, chain or workflow with the given name.
+	GetConfigsUsingComponent(name string, kind registry.Type) ([]*api.ReleaseBuildConfiguration, error)
 }
 
 // IndexFn can be used to add indexes to the ConfigAgent
@@ -40,13 +79,34 @@ type IndexFn func(api.ReleaseBuildConfiguration) []string
 type configAgent struct {
 	lock             *sync.RWMutex
 	configs          load.ByOrgRepo
+	files            map[string]api.ReleaseBuildConfiguration
 	configPath       string
 	generation       int
 	errorMetrics     *prometheus.CounterVec
 	indexFuncs       map[string]IndexFn
 	indexes          map[string]configIndex
 	indexSubscribers map[string][]chan IndexDelta
+	overlay          load.Overlay
+	nodes            nodeIndex
+	subscribers      []func(ConfigChange)
 	reloadConfig     func() error
+	reloadPaths      func(paths []string) error
+	// remote is the address of the configresolver the agent loads from, if any
+	remote string
+	// partial determines whether the agent loads the valid configs when
+	// others fail to load, recording their errors in fileErrors
+	partial    bool
+	fileErrors map[string]*load.FileError
+	// lazyValidation determines whether configs are validated on first access
+	// instead of when loading them, caching the results in validated
+	lazyValidation bool
+	validationLock sync.Mutex
+	validated      map[api.Metadata]error
+	// cache holds the parsed configs, which are reused for unchanged files
+	cache *load.ParseCache
+	// interner deduplicates the strings of loaded configs, like the org, repo
+	// and branch that many configs share
+	interner *load.Interner
 }
 
 type configIndex map[string][]*api.ReleaseBuildConfiguration
@@ -77,6 +137,9 @@ func NewFakeConfigAgent(configs load.ByOrgRepo) ConfigAgent {
 		a.buildIndexes()
 		return nil
 	}
+	a.reloadPaths = func(_ []string) error {
+		return a.reloadConfig()
+	}
 
 	return a
 }
@@ -85,6 +148,26 @@ type ConfigAgentOptions struct {
 	// ErrorMetric holds the CounterVec to count errors on. It must include a `error` label
 	// or the agent panics on the first error.
 	ErrorMetric *prometheus.CounterVec
+	// PartialLoad makes the agent load the valid configs when others fail to
+	// load instead of failing. The errors are available from LoadErrors.
+	PartialLoad bool
+	// LazyValidation makes the agent validate configs when GetMatchingConfig
+	// returns them for the first time instead of validating all configs when
+	// loading them. Other methods return configs that may not be valid.
+	LazyValidation bool
+	// CacheDir is a directory in which the agent stores the loaded configs. A
+	// new agent loads them from there instead of parsing the configs if they
+	// are in a git repository that is still at the same commit.
+	CacheDir string
+	// LowMemory makes the agent use less memory at the cost of loading and
+	// parsing files more often: it does not keep parsed files or YAML
+	// documents to reuse them.
+	LowMemory bool
+	// Watch makes NewConfigAgent reload only the configs that change on disk
+	// instead of all of them. Unless PollInterval is zero, all configs are
+	// also reloaded at that interval.
+	Watch        bool
+	PollInterval time.Duration
 }
 
 type ConfigAgentOption func(*ConfigAgentOptions)
@@ -95,24 +178,96 @@ func WithConfigMetrics(m *prometheus.CounterVec) ConfigAgentOption {
 	}
 }
 
+func WithConfigPartialLoad() ConfigAgentOption {
+	return func(o *ConfigAgentOptions) {
+		o.PartialLoad = true
+	}
+}
+
+func WithLazyValidation() ConfigAgentOption {
+	return func(o *ConfigAgentOptions) {
+		o.LazyValidation = true
+	}
+}
+
+func WithConfigWatch(pollInterval time.Duration) ConfigAgentOption {
+	return func(o *ConfigAgentOptions) {
+		o.Watch = true
+		o.PollInterval = pollInterval
+	}
+}
+
+func WithConfigLowMemory() ConfigAgentOption {
+	return func(o *ConfigAgentOptions) {
+		o.LowMemory = true
+	}
+}
+
+func WithConfigCacheDir(dir string) ConfigAgentOption {
+	return func(o *ConfigAgentOptions) {
+		o.CacheDir = dir
+	}
+}
+
 // NewConfigAgent returns a ConfigAgent interface that automatically reloads when
 // configs are changed on disk.
 func NewConfigAgent(configPath string, opts ...ConfigAgentOption) (ConfigAgent, error) {
-	opt := &ConfigAgentOptions{}
+	opt := ConfigAgentOptions{}
 	for _, o := range opts {
-		o(opt)
+		o(&opt)
+	}
+	a, err := newConfigAgent(configPath, opt)
+	if err != nil {
+		return nil, err
+	}
+	if !opt.Watch {
+		return a, startWatchers(a.configPath, a.reloadConfig, a.recordError)
+	}
+	if err := watchChanges(a.configPath, a.reloadConfig, a.ReloadPaths, a.recordError); err != nil {
+		return nil, err
 	}
+	pollReloads(a.reloadConfig, opt.PollInterval, a.recordError)
+	return a, nil
+}
+
+// newConfigAgent returns a configAgent that has loaded the configs in configPath
+// but does not watch them for changes
+func newConfigAgent(configPath string, opt ConfigAgentOptions) (*configAgent, error) {
 	if opt.ErrorMetric == nil {
 		opt.ErrorMetric = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "config_agent_errors_total"}, []string{"error"})
 	}
-	a := &configAgent{configPath: configPath, lock: &sync.RWMutex{}, errorMetrics: opt.ErrorMetric}
+	a := &configAgent{configPath: configPath, lock: &sync.RWMutex{}, errorMetrics: opt.ErrorMetric, partial: opt.PartialLoad, lazyValidation: opt.LazyValidation, interner: load.NewInterner()}
+	if opt.LowMemory {
+		a.nodes.transient = true
+	} else {
+		a.cache = newParseCache()
+	}
 	a.reloadConfig = a.loadFilenameToConfig
+	a.reloadPaths = a.loadPaths
+	// configs that were not validated must not be used by agents that validate
+	diskCache := newDiskCache(opt.CacheDir, "config", fmt.Sprintf("lazy-validation=%t", a.lazyValidation), configPath)
+	var cached map[string]api.ReleaseBuildConfiguration
+	if diskCache.load(&cached) {
+		for path, config := range cached {
+			a.interner.Intern(&config)
+			cached[path] = config
+		}
+		if err := a.reload(func() (map[string]api.ReleaseBuildConfiguration, error) {
+			return cached, nil
+		}); err != nil {
+			return nil, fmt.Errorf("failed to load cached config: %w", err)
+		}
+		return a, nil
+	}
 	// Load config once so we fail early if that doesn't work and are ready as soon as we return
 	if err := a.reloadConfig(); err != nil {
 		return nil, fmt.Errorf("failed to laod config: %w", err)
 	}
-
-	return a, startWatchers(a.configPath, a.reloadConfig, a.recordError)
+	// the cache does not hold the errors of a partial load
+	if len(a.fileErrors) == 0 {
+		diskCache.store(a.files)
+	}
+	return a, nil
 }
 
 func (a *configAgent) recordError(label string) {
@@ -151,18 +306,88 @@ func (a *configAgent) GetMatchingConfig(metadata api.Metadata) (api.ReleaseBuild
 	case 0:
 		return api.ReleaseBuildConfiguration{}, fmt.Errorf("could not find any config for branch %s on repo %s/%s", metadata.Branch, metadata.Org, metadata.Repo)
 	case 1:
+		if a.lazyValidation {
+			if err := a.validate(matchingConfigs[0]); err != nil {
+				return api.ReleaseBuildConfiguration{}, err
+			}
+		}
 		return matchingConfigs[0], nil
 	default:
 		return api.ReleaseBuildConfiguration{}, fmt.Errorf("found more than one matching config for branch %s on repo %s/%s", metadata.Branch, metadata.Org, metadata.Repo)
 	}
 }
 
+// validate validates the config unless it was validated since the last reload
+func (a *configAgent) validate(config api.ReleaseBuildConfiguration) error {
+	a.validationLock.Lock()
+	defer a.validationLock.Unlock()
+	if err, validated := a.validated[config.Metadata]; validated {
+		return err
+	}
+	err := validation.IsValidRuntimeConfiguration(&config)
+	if err != nil {
+		err = fmt.Errorf("invalid ci-operator config for %s: %w", config.Metadata.AsString(), err)
+	}
+	if a.validated == nil {
+		a.validated = map[api.Metadata]error{}
+	}
+	a.validated[config.Metadata] = err
+	return err
+}
+
 func (a *configAgent) GetAll() load.ByOrgRepo {
 	a.lock.RLock()
 	defer a.lock.RUnlock()
 	return a.configs
 }
 
+func (a *configAgent) Search(query api.Metadata) []api.Metadata {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	type match struct {
+		metadata api.Metadata
+		score    int
+	}
+	var matches []match
+	for _, orgConfigs := range a.configs {
+		for _, repoConfigs := range orgConfigs {
+			for _, config := range repoConfigs {
+				score, matched := 0, true
+				for _, field := range []struct{ query, value string }{
+					{query: query.Org, value: config.Metadata.Org},
+					{query: query.Repo, value: config.Metadata.Repo},
+					{query: query.Branch, value: config.Metadata.Branch},
+					{query: query.Variant, value: config.Metadata.Variant},
+				} {
+					if field.query == "" {
+						continue
+					}
+					fieldScore, fieldMatched := fuzzyMatch(field.query, field.value)
+					if !fieldMatched {
+						matched = false
+						break
+					}
+					score += fieldScore
+				}
+				if matched {
+					matches = append(matches, match{metadata: config.Metadata, score: score})
+				}
+			}
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].metadata.AsString() < matches[j].metadata.AsString()
+	})
+	var result []api.Metadata
+	for _, match := range matches {
+		result = append(result, match.metadata)
+	}
+	return result
+}
+
 func (a *configAgent) GetGeneration() int {
 	a.lock.RLock()
 	defer a.lock.RUnlock()
@@ -218,59 +443,241 @@ func (a *configAgent) SubscribeToIndexChanges(indexName string) (<-chan IndexDel
 	return newChan, nil
 }
 
+func (a *configAgent) SetOverlay(path string, content []byte) error {
+	if a.remote != "" {
+		return errRemoteAgent
+	}
+	return updateOverlay(a.lock, &a.overlay, a.configPath, path, content, false, a.reloadPaths)
+}
+
+func (a *configAgent) RemoveOverlay(path string) error {
+	if a.remote != "" {
+		return errRemoteAgent
+	}
+	return updateOverlay(a.lock, &a.overlay, a.configPath, path, nil, true, a.reloadPaths)
+}
+
+func (a *configAgent) Subscribe(callback func(ConfigChange)) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.subscribers = append(a.subscribers, callback)
+}
+
+func (a *configAgent) ReloadPaths(paths []string) error {
+	return a.reloadPaths(paths)
+}
+
+func (a *configAgent) Node(path string) (*yaml.Node, error) {
+	if a.remote != "" {
+		return nil, errRemoteAgent
+	}
+	key, err := overlayPath(a.configPath, path)
+	if err != nil {
+		return nil, err
+	}
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.nodes.get(key, a.overlay)
+}
+
 // loadFilenameToConfig generates a new filenameToConfig map.
 func (a *configAgent) loadFilenameToConfig() error {
 	logrus.Debug("Reloading configs")
+	return a.reload(func() (map[string]api.ReleaseBuildConfiguration, error) {
+		a.nodes.reset()
+		files, err := a.configsByPath(a.configPath)
+		fileErrors, err := a.tolerateFileErrors(err)
+		if err != nil {
+			return nil, err
+		}
+		a.retainStrings(files)
+		a.fileErrors = map[string]*load.FileError{}
+		for _, fileErr := range fileErrors {
+			a.fileErrors[fileErr.Path] = fileErr
+		}
+		return files, nil
+	})
+}
+
+// configsByPath loads the configs at or below path, validating them unless
+// validation is lazy
+func (a *configAgent) configsByPath(path string) (map[string]api.ReleaseBuildConfiguration, error) {
+	configs, err := load.ConfigsByPathWithOptions(path, a.overlay, load.ConfigLoadOptions{SkipValidation: a.lazyValidation, Cache: a.cache, Interner: a.interner})
+	fileErrors, _ := load.FileErrors(err)
+	for range fileErrors {
+		a.recordError("failed to load config file")
+	}
+	return configs, err
+}
+
+// tolerateFileErrors returns the errors of single files in err if the agent
+// loads partially, and any other errors
+func (a *configAgent) tolerateFileErrors(err error) ([]*load.FileError, error) {
+	if !a.partial {
+		return nil, err
+	}
+	return load.FileErrors(err)
+}
+
+func (a *configAgent) LoadErrors() []*load.FileError {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	var fileErrors []*load.FileError
+	for _, fileErr := range a.fileErrors {
+		fileErrors = append(fileErrors, fileErr)
+	}
+	sort.Slice(fileErrors, func(i, j int) bool {
+		return fileErrors[i].Path < fileErrors[j].Path
+	})
+	return fileErrors
+}
+
+// loadPaths reloads the configs at or below the given paths
+func (a *configAgent) loadPaths(paths []string) error {
+	logrus.WithField("paths", paths).Debug("Reloading configs in paths")
+	return a.reload(func() (map[string]api.ReleaseBuildConfiguration, error) {
+		files := make(map[string]api.ReleaseBuildConfiguration, len(a.files))
+		for path, config := range a.files {
+			files[path] = config
+		}
+		fileErrors := make(map[string]*load.FileError, len(a.fileErrors))
+		for path, fileErr := range a.fileErrors {
+			fileErrors[path] = fileErr
+		}
+		for _, path := range paths {
+			path, err := overlayPath(a.configPath, path)
+			if err != nil {
+				logrus.WithError(err).Debug("Ignoring path outside of the config directory")
+				continue
+			}
+			a.nodes.invalidate([]string{path})
+			for existing := range files {
+				if isUnder(path, existing) {
+					delete(files, existing)
+				}
+			}
+			for existing := range fileErrors {
+				if isUnder(path, existing) {
+					delete(fileErrors, existing)
+				}
+			}
+			found, err := a.configsByPath(path)
+			foundErrors, err := a.tolerateFileErrors(err)
+			if err != nil {
+				return nil, err
+			}
+			for path, config := range found {
+				files[path] = config
+			}
+			for _, fileErr := range foundErrors {
+				fileErrors[fileErr.Path] = fileErr
+			}
+		}
+		a.fileErrors = fileErrors
+		a.retainStrings(files)
+		return files, nil
+	})
+}
+
+// retainStrings makes the interner forget the strings of configs that no
+// longer exist; the interner is kept so that cached configs share strings with
+// new ones
+func (a *configAgent) retainStrings(files map[string]api.ReleaseBuildConfiguration) {
+	if a.interner == nil {
+		return
+	}
+	configs := make([]api.ReleaseBuildConfiguration, 0, len(files))
+	for _, config := range files {
+		configs = append(configs, config)
+	}
+	a.interner.Retain(configs)
+}
+
+// reload replaces the configs with the ones returned by loadFiles, which is
+// called while holding the lock
+func (a *configAgent) reload(loadFiles func() (map[string]api.ReleaseBuildConfiguration, error)) error {
+	var change ConfigChange
+	var subscribers []func(ConfigChange)
+	var files int
 	duration, err := func() (time.Duration, error) {
 		a.lock.Lock()
 		defer a.lock.Unlock()
 		startTime := time.Now()
-		configs, err := load.FromPathByOrgRepo(a.configPath)
+		loaded, err := loadFiles()
 		if err != nil {
 			return time.Duration(0), fmt.Errorf("loading config failed: %w", err)
 		}
+		configs := load.PartitionByOrgRepo(loaded)
+		if len(a.subscribers) > 0 {
+			change = diffConfigs(a.configs, configs)
+			subscribers = append(subscribers, a.subscribers...)
+		}
+		a.files = loaded
+		files = len(loaded)
 		a.configs = configs
+		a.validated = nil
 		a.buildIndexes()
 		a.generation++
+		change.Generation = a.generation
 		return time.Since(startTime), nil
 	}()
 	if err != nil {
 		return err
 	}
 	configReloadTimeMetric.Observe(duration.Seconds())
-	logrus.WithField("duration", duration.String()).Info("Configs reloaded")
+	recordLoad("config", a.configPath, files)
+	logrus.WithFields(logrus.Fields{"duration": duration.String(), "files": files}).Info("Configs reloaded")
+	for _, subscriber := range subscribers {
+		subscriber(change)
+	}
 	return nil
 }
 
+// diffConfigs determines which configs were added, changed or removed between
+// two sets of configs, identifying them by their metadata
+func diffConfigs(oldConfigs, newConfigs load.ByOrgRepo) ConfigChange {
+	byMetadata := func(configs load.ByOrgRepo) map[api.Metadata]*api.ReleaseBuildConfiguration {
+		result := map[api.Metadata]*api.ReleaseBuildConfiguration{}
+		for _, orgConfigs := range configs {
+			for _, repoConfigs := range orgConfigs {
+				for i := range repoConfigs {
+					result[repoConfigs[i].Metadata] = &repoConfigs[i]
+				}
+			}
+		}
+		return result
+	}
+	oldByMetadata, newByMetadata := byMetadata(oldConfigs), byMetadata(newConfigs)
+
+	var change ConfigChange
+	for metadata, newConfig := range newByMetadata {
+		oldConfig, existed := oldByMetadata[metadata]
+		switch {
+		case !existed:
+			change.Added = append(change.Added, metadata)
+		case !reflect.DeepEqual(oldConfig, newConfig):
+			change.Changed = append(change.Changed, metadata)
+		}
+	}
+	for metadata := range oldByMetadata {
+		if _, exists := newByMetadata[metadata]; !exists {
+			change.Removed = append(change.Removed, metadata)
+		}
+	}
+	for _, list := range [][]api.Metadata{change.Added, change.Changed, change.Removed} {
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].AsString() < list[j].AsString()
+		})
+	}
+	return change
+}
+
 func (a *configAgent) buildIndexes() {
 	oldIndexes := a.indexes
 
 	a.indexes = map[string]configIndex{}
 	for indexName, indexFunc := range a.indexFuncs {
-		// Make sure the index always exists even if empty, otherwise we return a confusing
-		// "index does not exist error" in case its empty
-		if _, exists := a.indexes[indexName]; !exists {
-			a.indexes[indexName] = configIndex{}
-		}
-		for _, orgConfigs := range a.configs {
-			for _, repoConfigs := range orgConfigs {
-				for _, config := range repoConfigs {
-					var resusableConfigPtr *api.ReleaseBuildConfiguration
-
-					for _, indexKey := range indexFunc(config) {
-						if resusableConfigPtr == nil {
-							config := config
-							resusableConfigPtr = &config
-						}
-						if _, exists := a.indexes[indexName][indexKey]; !exists {
-							a.indexes[indexName][indexKey] = []*api.ReleaseBuildConfiguration{}
-						}
-
-						a.indexes[indexName][indexKey] = append(a.indexes[indexName][indexKey], resusableConfigPtr)
-					}
-				}
-			}
-		}
+		a.indexes[indexName] = a.buildIndex(indexFunc)
 
 		// Building the diff is expensive, so cache it in case we have multiple
 		// subscribers.
@@ -291,6 +698,28 @@ func (a *configAgent) buildIndexes() {
 	}
 }
 
+// buildIndex indexes the loaded configs with indexFunc. The index is never nil,
+// otherwise we return a confusing "index does not exist error" in case its empty.
+func (a *configAgent) buildIndex(indexFunc IndexFn) configIndex {
+	index := configIndex{}
+	for _, orgConfigs := range a.configs {
+		for _, repoConfigs := range orgConfigs {
+			for _, config := range repoConfigs {
+				var resusableConfigPtr *api.ReleaseBuildConfiguration
+
+				for _, indexKey := range indexFunc(config) {
+					if resusableConfigPtr == nil {
+						config := config
+						resusableConfigPtr = &config
+					}
+					index[indexKey] = append(index[indexKey], resusableConfigPtr)
+				}
+			}
+		}
+	}
+	return index
+}
+
 // configByFilenameFromIndex constructs a map indexKey -> Metadata -> config for the config
 // in the provided index. It uses the fact that Metadata is unique per config to speed up
 // looking up specific values in an index.
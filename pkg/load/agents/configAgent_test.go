@@ -2,14 +2,27 @@ package agents
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"sort"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+	"unsafe"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 
 	"github.com/openshift/ci-tools/pkg/api"
 	"github.com/openshift/ci-tools/pkg/load"
+	"github.com/openshift/ci-tools/pkg/registry"
+	"github.com/openshift/ci-tools/pkg/testhelper"
 )
 
 func TestGetFromIndex(t *testing.T) {
@@ -565,3 +578,553 @@ func TestBuildIndexDelta(t *testing.T) {
 		})
 	}
 }
+
+func TestConfigAgentOverlay(t *testing.T) {
+	config := func(test string) []byte {
+		return testhelper.CIOperatorConfig("org", "repo", "master", test)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "org-repo-master.yaml")
+	if err := ioutil.WriteFile(path, config("unit"), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	agent := &configAgent{lock: &sync.RWMutex{}, configPath: dir, errorMetrics: prometheus.NewCounterVec(prometheus.CounterOpts{}, []string{"error"})}
+	agent.reloadConfig = agent.loadFilenameToConfig
+	agent.reloadPaths = agent.loadPaths
+	if err := agent.reloadConfig(); err != nil {
+		t.Fatalf("failed to load configs: %v", err)
+	}
+	testName := func() string {
+		return agent.GetAll()["org"]["repo"][0].Tests[0].As
+	}
+
+	if err := agent.SetOverlay(path, config("lint")); err != nil {
+		t.Fatalf("failed to set overlay: %v", err)
+	}
+	if actual := testName(); actual != "lint" {
+		t.Errorf("expected overlay to take precedence, got test %q", actual)
+	}
+	if err := agent.SetOverlay(path, []byte("tests: {")); err == nil {
+		t.Error("expected setting an invalid overlay to fail")
+	}
+	if actual := testName(); actual != "lint" {
+		t.Errorf("expected failed overlay to be rolled back, got test %q", actual)
+	}
+	if err := agent.SetOverlay(filepath.Join(filepath.Dir(dir), "other.yaml"), config("e2e")); err == nil {
+		t.Error("expected setting an overlay outside of the config path to fail")
+	}
+	if err := agent.RemoveOverlay(path); err != nil {
+		t.Fatalf("failed to remove overlay: %v", err)
+	}
+	if actual := testName(); actual != "unit" {
+		t.Errorf("expected file on disk after removing the overlay, got test %q", actual)
+	}
+}
+
+func TestDiffConfigs(t *testing.T) {
+	metadata := func(branch string) api.Metadata {
+		return api.Metadata{Org: "org", Repo: "repo", Branch: branch}
+	}
+	config := func(branch, commands string) api.ReleaseBuildConfiguration {
+		return api.ReleaseBuildConfiguration{Metadata: metadata(branch), TestBinaryBuildCommands: commands}
+	}
+	oldConfigs := load.ByOrgRepo{"org": {"repo": {
+		config("master", "make test"),
+		config("release-4.9", "make test"),
+		config("release-4.8", "make test"),
+	}}}
+	newConfigs := load.ByOrgRepo{"org": {"repo": {
+		config("master", "make test"),
+		config("release-4.9", "make test-unit"),
+		config("release-4.10", "make test"),
+	}}}
+	expected := ConfigChange{
+		Added:   []api.Metadata{metadata("release-4.10")},
+		Changed: []api.Metadata{metadata("release-4.9")},
+		Removed: []api.Metadata{metadata("release-4.8")},
+	}
+	if diff := cmp.Diff(expected, diffConfigs(oldConfigs, newConfigs)); diff != "" {
+		t.Errorf("expected change does not match actual change, diff: %v", diff)
+	}
+}
+
+func TestConfigAgent_ReloadPaths(t *testing.T) {
+	config := func(branch string) []byte {
+		return testhelper.CIOperatorConfig("org", "repo", branch, "unit")
+	}
+	dir := t.TempDir()
+	repoDir := filepath.Join(dir, "org", "repo")
+	if err := os.MkdirAll(repoDir, 0755); err != nil {
+		t.Fatalf("failed to create config dir: %v", err)
+	}
+	write := func(name string, content []byte) {
+		if err := ioutil.WriteFile(filepath.Join(repoDir, name), content, 0644); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+	}
+	write("org-repo-master.yaml", config("master"))
+	write("org-repo-release-4.9.yaml", config("release-4.9"))
+
+	agent := &configAgent{lock: &sync.RWMutex{}, configPath: dir, errorMetrics: prometheus.NewCounterVec(prometheus.CounterOpts{}, []string{"error"})}
+	agent.reloadConfig = agent.loadFilenameToConfig
+	agent.reloadPaths = agent.loadPaths
+	if err := agent.reloadConfig(); err != nil {
+		t.Fatalf("failed to load configs: %v", err)
+	}
+	var changes []ConfigChange
+	agent.Subscribe(func(change ConfigChange) {
+		changes = append(changes, change)
+	})
+
+	write("org-repo-release-4.10.yaml", config("release-4.10"))
+	if err := os.Remove(filepath.Join(repoDir, "org-repo-release-4.9.yaml")); err != nil {
+		t.Fatalf("failed to remove config: %v", err)
+	}
+	// not reloaded, so the agent must not notice it
+	write("org-repo-release-4.8.yaml", config("release-4.8"))
+	if err := agent.ReloadPaths([]string{
+		filepath.Join(repoDir, "org-repo-release-4.10.yaml"),
+		filepath.Join(repoDir, "org-repo-release-4.9.yaml"),
+		filepath.Join(filepath.Dir(dir), "elsewhere.yaml"),
+	}); err != nil {
+		t.Fatalf("failed to reload paths: %v", err)
+	}
+
+	loadedEntries := &dto.Metric{}
+	if err := loadedEntriesMetric.WithLabelValues("config", dir).Write(loadedEntries); err != nil {
+		t.Fatalf("failed to read metric: %v", err)
+	}
+	if actual := loadedEntries.GetGauge().GetValue(); actual != 2 {
+		t.Errorf("expected the agent to record 2 loaded configs, got %v", actual)
+	}
+
+	write("org-repo-master.yaml", []byte("tests: {"))
+	if err := agent.ReloadPaths([]string{repoDir}); err == nil {
+		t.Error("expected reloading an invalid config to fail")
+	}
+	loadErrors := &dto.Metric{}
+	if err := agent.errorMetrics.WithLabelValues("failed to load config file").Write(loadErrors); err != nil {
+		t.Fatalf("failed to read metric: %v", err)
+	}
+	if actual := loadErrors.GetCounter().GetValue(); actual != 1 {
+		t.Errorf("expected the agent to count 1 file that failed to load, got %v", actual)
+	}
+
+	metadata := func(branch string) api.Metadata {
+		return api.Metadata{Org: "org", Repo: "repo", Branch: branch}
+	}
+	expected := []ConfigChange{{
+		Generation: 2,
+		Added:      []api.Metadata{metadata("release-4.10")},
+		Removed:    []api.Metadata{metadata("release-4.9")},
+	}}
+	if diff := cmp.Diff(expected, changes); diff != "" {
+		t.Errorf("expected changes do not match actual changes, diff: %v", diff)
+	}
+	var branches []string
+	for _, config := range agent.GetAll()["org"]["repo"] {
+		branches = append(branches, config.Metadata.Branch)
+	}
+	sort.Strings(branches)
+	if diff := cmp.Diff([]string{"master", "release-4.10"}, branches); diff != "" {
+		t.Errorf("expected configs do not match actual configs, diff: %v", diff)
+	}
+}
+
+func TestConfigAgent_Node(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "org-repo-master.yaml")
+	if err := ioutil.WriteFile(path, []byte("resources:\n  '*':\n    requests:\n      cpu: 100m\ntests:\n- as: unit\n"), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	agent := &configAgent{lock: &sync.RWMutex{}, configPath: dir, errorMetrics: prometheus.NewCounterVec(prometheus.CounterOpts{}, []string{"error"})}
+	agent.reloadPaths = func(paths []string) error {
+		agent.lock.Lock()
+		defer agent.lock.Unlock()
+		agent.nodes.invalidate(paths)
+		return nil
+	}
+
+	// position returns the line and column of the value under key in the top-level mapping
+	position := func(key string) [2]int {
+		t.Helper()
+		node, err := agent.Node(path)
+		if err != nil {
+			t.Fatalf("failed to get node: %v", err)
+		}
+		mapping := node.Content[0]
+		for i := 0; i < len(mapping.Content); i += 2 {
+			if mapping.Content[i].Value == key {
+				return [2]int{mapping.Content[i+1].Line, mapping.Content[i+1].Column}
+			}
+		}
+		t.Fatalf("no key %s in %s", key, path)
+		return [2]int{}
+	}
+
+	if diff := cmp.Diff([2]int{6, 1}, position("tests")); diff != "" {
+		t.Errorf("unexpected position on disk, diff: %v", diff)
+	}
+	if err := agent.SetOverlay(path, []byte("tests:\n  - as: unit\n")); err != nil {
+		t.Fatalf("failed to set overlay: %v", err)
+	}
+	if diff := cmp.Diff([2]int{2, 3}, position("tests")); diff != "" {
+		t.Errorf("unexpected position in overlay, diff: %v", diff)
+	}
+	if _, err := agent.Node(filepath.Join(filepath.Dir(dir), "elsewhere.yaml")); err == nil {
+		t.Error("expected getting a node outside of the config directory to fail")
+	}
+}
+
+func TestConfigAgent_Search(t *testing.T) {
+	metadata := []api.Metadata{
+		{Org: "openshift", Repo: "ci-tools", Branch: "master"},
+		{Org: "openshift", Repo: "ci-docs", Branch: "master"},
+		{Org: "openshift", Repo: "installer", Branch: "master"},
+		{Org: "openshift", Repo: "installer", Branch: "release-4.9"},
+		{Org: "openshift", Repo: "installer", Branch: "release-4.9", Variant: "okd"},
+		{Org: "openshift-priv", Repo: "installer", Branch: "master"},
+	}
+	configs := load.ByOrgRepo{}
+	for _, m := range metadata {
+		if configs[m.Org] == nil {
+			configs[m.Org] = map[string][]api.ReleaseBuildConfiguration{}
+		}
+		configs[m.Org][m.Repo] = append(configs[m.Org][m.Repo], api.ReleaseBuildConfiguration{Metadata: m})
+	}
+	agent := NewFakeConfigAgent(configs)
+
+	testCases := []struct {
+		name     string
+		query    api.Metadata
+		expected []api.Metadata
+	}{
+		{
+			name:     "exact matches rank before prefix matches",
+			query:    api.Metadata{Org: "openshift", Repo: "installer", Branch: "master"},
+			expected: []api.Metadata{metadata[2], metadata[5]},
+		},
+		{
+			name:     "substring of a field",
+			query:    api.Metadata{Repo: "docs"},
+			expected: []api.Metadata{metadata[1]},
+		},
+		{
+			name:     "characters in order, ignoring case",
+			query:    api.Metadata{Repo: "CTLS"},
+			expected: []api.Metadata{metadata[0]},
+		},
+		{
+			name:     "fuzzy matches are sorted by name",
+			query:    api.Metadata{Branch: "re4"},
+			expected: []api.Metadata{metadata[3], metadata[4]},
+		},
+		{
+			name:     "variant",
+			query:    api.Metadata{Variant: "okd"},
+			expected: []api.Metadata{metadata[4]},
+		},
+		{
+			name:  "no match",
+			query: api.Metadata{Repo: "origin"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.expected, agent.Search(tc.query)); diff != "" {
+				t.Errorf("expected result does not match actual result, diff: %v", diff)
+			}
+		})
+	}
+}
+
+func TestConfigAgent_PartialLoad(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+	}
+	write("org-repo-master.yaml", string(testhelper.CIOperatorConfig("org", "repo", "master", "unit")))
+	write("org-repo-broken.yaml", "tests: []\nbuild_root: image: stream\n")
+
+	if _, err := newConfigAgent(dir, ConfigAgentOptions{}); err == nil {
+		t.Error("expected loading a broken config to fail without partial loading")
+	}
+	agent, err := newConfigAgent(dir, ConfigAgentOptions{PartialLoad: true})
+	if err != nil {
+		t.Fatalf("failed to load configs partially: %v", err)
+	}
+	if _, err := agent.GetMatchingConfig(api.Metadata{Org: "org", Repo: "repo", Branch: "master"}); err != nil {
+		t.Errorf("expected the valid config to be loaded: %v", err)
+	}
+	errorLines := func() map[string]int {
+		lines := map[string]int{}
+		for _, fileErr := range agent.LoadErrors() {
+			lines[filepath.Base(fileErr.Path)] = fileErr.Line
+		}
+		return lines
+	}
+	if diff := cmp.Diff(map[string]int{"org-repo-broken.yaml": 2}, errorLines()); diff != "" {
+		t.Errorf("unexpected load errors, diff: %v", diff)
+	}
+
+	write("org-repo-broken.yaml", string(testhelper.CIOperatorConfig("org", "repo", "release-4.9", "unit")))
+	if err := agent.ReloadPaths([]string{filepath.Join(dir, "org-repo-broken.yaml")}); err != nil {
+		t.Fatalf("failed to reload fixed config: %v", err)
+	}
+	if diff := cmp.Diff(map[string]int{}, errorLines()); diff != "" {
+		t.Errorf("expected no load errors after fixing the config, diff: %v", diff)
+	}
+	if _, err := agent.GetMatchingConfig(api.Metadata{Org: "org", Repo: "repo", Branch: "release-4.9"}); err != nil {
+		t.Errorf("expected the fixed config to be loaded: %v", err)
+	}
+}
+
+func TestConfigAgent_LazyValidation(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+	}
+	write("org-repo-master.yaml", string(testhelper.CIOperatorConfig("org", "repo", "master", "unit")))
+	// a container test without commands is not valid
+	invalid := strings.Replace(string(testhelper.CIOperatorConfig("org", "repo", "invalid", "unit")), "  commands: make unit\n", "", 1)
+	write("org-repo-invalid.yaml", invalid)
+
+	if _, err := newConfigAgent(dir, ConfigAgentOptions{}); err == nil {
+		t.Error("expected loading an invalid config to fail with eager validation")
+	}
+	agent, err := newConfigAgent(dir, ConfigAgentOptions{LazyValidation: true})
+	if err != nil {
+		t.Fatalf("failed to load configs with lazy validation: %v", err)
+	}
+	if _, err := agent.GetMatchingConfig(api.Metadata{Org: "org", Repo: "repo", Branch: "master"}); err != nil {
+		t.Errorf("expected the valid config to be returned: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := agent.GetMatchingConfig(api.Metadata{Org: "org", Repo: "repo", Branch: "invalid"}); err == nil {
+			t.Error("expected getting the invalid config to fail")
+		}
+	}
+	if len(agent.validated) != 2 {
+		t.Errorf("expected validation results for two configs to be cached, got %d", len(agent.validated))
+	}
+}
+
+func TestConfigAgent_LowMemory(t *testing.T) {
+	dir := t.TempDir()
+	for _, branch := range []string{"master", "release-4.9"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "org-repo-"+branch+".yaml"), testhelper.CIOperatorConfig("org", "repo", branch, "unit"), 0644); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+	}
+	agent, err := newConfigAgent(dir, ConfigAgentOptions{LowMemory: true})
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	if agent.cache != nil {
+		t.Error("expected an agent that uses little memory not to keep parsed files")
+	}
+	configs := agent.GetAll()["org"]["repo"]
+	if len(configs) != 2 {
+		t.Fatalf("expected 2 configs, got %d", len(configs))
+	}
+	data := func(s string) uintptr {
+		return (*reflect.StringHeader)(unsafe.Pointer(&s)).Data
+	}
+	if data(configs[0].Tests[0].Commands) != data(configs[1].Tests[0].Commands) {
+		t.Error("expected equal strings of the configs to be deduplicated")
+	}
+	if _, err := agent.Node(filepath.Join(dir, "org-repo-master.yaml")); err != nil {
+		t.Fatalf("failed to get node: %v", err)
+	}
+	if len(agent.nodes.nodes) != 0 {
+		t.Error("expected an agent that uses little memory not to keep parsed nodes")
+	}
+
+	agent, err = newConfigAgent(dir, ConfigAgentOptions{})
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	configs = agent.GetAll()["org"]["repo"]
+	if data(configs[0].Metadata.Org) != data(configs[1].Metadata.Org) {
+		t.Error("expected equal strings of the configs to be deduplicated by default")
+	}
+}
+
+func TestLazyConfigAgent(t *testing.T) {
+	dir := t.TempDir()
+	var created int
+	agent := &lazyConfigAgent{create: func() (ConfigAgent, error) {
+		created++
+		return newConfigAgent(dir, ConfigAgentOptions{})
+	}}
+	// the configs are loaded on first use, so they do not need to exist yet
+	if err := ioutil.WriteFile(filepath.Join(dir, "org-repo-master.yaml"), testhelper.CIOperatorConfig("org", "repo", "master", "unit"), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	if created != 0 {
+		t.Fatal("expected the agent not to be created before it is used")
+	}
+	if _, err := agent.GetMatchingConfig(api.Metadata{Org: "org", Repo: "repo", Branch: "master"}); err != nil {
+		t.Errorf("failed to get config: %v", err)
+	}
+	if generation := agent.GetGeneration(); generation != 1 {
+		t.Errorf("expected generation 1, got %d", generation)
+	}
+	if created != 1 {
+		t.Errorf("expected the agent to be created once, got %d times", created)
+	}
+
+	var changes []ConfigChange
+	fail, attempts, now := true, 0, time.Now()
+	failing := &lazyConfigAgent{
+		create: func() (ConfigAgent, error) {
+			attempts++
+			if fail {
+				return nil, errors.New("injected failure")
+			}
+			return newConfigAgent(dir, ConfigAgentOptions{})
+		},
+		now: func() time.Time { return now },
+	}
+	// subscribing does not create the agent
+	failing.Subscribe(func(change ConfigChange) {
+		changes = append(changes, change)
+	})
+	if attempts != 0 {
+		t.Errorf("expected subscribing not to create the agent, got %d attempts", attempts)
+	}
+	if _, err := failing.GetMatchingConfig(api.Metadata{Org: "org", Repo: "repo", Branch: "master"}); err == nil {
+		t.Error("expected using an agent that failed to be created to fail")
+	}
+	if configs := failing.GetAll(); configs != nil {
+		t.Errorf("expected no configs from an agent that failed to be created, got %v", configs)
+	}
+	if attempts != 1 {
+		t.Errorf("expected the agent not to be created again before the retry period passed, got %d attempts", attempts)
+	}
+
+	// a temporary failure does not disable the agent
+	fail = false
+	if _, err := failing.GetMatchingConfig(api.Metadata{Org: "org", Repo: "repo", Branch: "master"}); err == nil {
+		t.Error("expected the error to be returned until the retry period passed")
+	}
+	now = now.Add(lazyCreateRetryPeriod)
+	if _, err := failing.GetMatchingConfig(api.Metadata{Org: "org", Repo: "repo", Branch: "master"}); err != nil {
+		t.Errorf("expected the agent to be created once it does not fail anymore: %v", err)
+	}
+	if err := failing.ReloadPaths([]string{filepath.Join(dir, "org-repo-master.yaml")}); err != nil {
+		t.Fatalf("failed to reload paths: %v", err)
+	}
+	if len(changes) != 1 {
+		t.Errorf("expected the callback subscribed before the agent was created to be called once, got %d calls", len(changes))
+	}
+}
+
+func TestConfigAgent_GetConfigsUsingComponent(t *testing.T) {
+	str := func(s string) *string { return &s }
+	config := func(branch string, tests ...api.MultiStageTestConfiguration) api.ReleaseBuildConfiguration {
+		config := api.ReleaseBuildConfiguration{Metadata: api.Metadata{Org: "org", Repo: "repo", Branch: branch}}
+		for i := range tests {
+			config.Tests = append(config.Tests, api.TestStepConfiguration{As: fmt.Sprintf("e2e-%d", i), MultiStageTestConfiguration: &tests[i]})
+		}
+		return config
+	}
+	master := config("master", api.MultiStageTestConfiguration{Workflow: str("ipi"), Test: []api.TestStep{{Reference: str("e2e-test")}}})
+	release := config("release-4.9",
+		api.MultiStageTestConfiguration{Workflow: str("ipi")},
+		api.MultiStageTestConfiguration{Pre: []api.TestStep{{Chain: str("ipi-install")}}, Test: []api.TestStep{{LiteralTestStep: &api.LiteralTestStep{As: "literal"}}}},
+	)
+	unrelated := api.ReleaseBuildConfiguration{Metadata: api.Metadata{Org: "org", Repo: "other", Branch: "master"}, Tests: []api.TestStepConfiguration{{As: "unit"}}}
+	agent := NewFakeConfigAgent(load.ByOrgRepo{"org": {"repo": {release, master}, "other": {unrelated}}}).(*configAgent)
+	// the index is only built for agents that need it
+	if _, exists := agent.indexes[componentIndexName]; exists {
+		t.Error("expected the component index not to be built before it is used")
+	}
+
+	for _, testCase := range []struct {
+		name     string
+		kind     registry.Type
+		expected []api.Metadata
+	}{
+		{name: "ipi", kind: registry.Workflow, expected: []api.Metadata{master.Metadata, release.Metadata}},
+		{name: "e2e-test", kind: registry.Reference, expected: []api.Metadata{master.Metadata}},
+		{name: "ipi-install", kind: registry.Chain, expected: []api.Metadata{release.Metadata}},
+		{name: "ipi", kind: registry.Chain},
+		{name: "literal", kind: registry.Reference},
+	} {
+		configs, err := agent.GetConfigsUsingComponent(testCase.name, testCase.kind)
+		if err != nil {
+			t.Fatalf("failed to get configs using %s %s: %v", testCase.kind, testCase.name, err)
+		}
+		var actual []api.Metadata
+		for _, config := range configs {
+			actual = append(actual, config.Metadata)
+		}
+		if diff := cmp.Diff(testCase.expected, actual); diff != "" {
+			t.Errorf("unexpected configs using %s %s, diff: %v", testCase.kind, testCase.name, diff)
+		}
+	}
+	if _, err := agent.GetConfigsUsingComponent("ipi", registry.Type(42)); err == nil {
+		t.Error("expected getting configs using a component of an unknown type to fail")
+	}
+	if len(agent.indexFuncs) != 1 {
+		t.Errorf("expected the component index to be added once, got %d indexes", len(agent.indexFuncs))
+	}
+}
+
+func TestConfigAgent_GetConfigsUsingComponentDoesNotReload(t *testing.T) {
+	dir := t.TempDir()
+	repoDir := filepath.Join(dir, "org", "repo")
+	if err := os.MkdirAll(repoDir, 0755); err != nil {
+		t.Fatalf("failed to create config dir: %v", err)
+	}
+	config := []byte(`resources:
+  '*':
+    requests:
+      cpu: 10m
+tests:
+- as: e2e
+  steps:
+    workflow: ipi
+zz_generated_metadata:
+  org: org
+  repo: repo
+  branch: master
+`)
+	if err := ioutil.WriteFile(filepath.Join(repoDir, "org-repo-master.yaml"), config, 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	agent, err := NewConfigAgent(dir)
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	// the watchers also reload once the directory is removed after the test
+	var lock sync.Mutex
+	var changes int
+	agent.Subscribe(func(ConfigChange) {
+		lock.Lock()
+		defer lock.Unlock()
+		changes++
+	})
+	generation := agent.GetGeneration()
+
+	configs, err := agent.GetConfigsUsingComponent("ipi", registry.Workflow)
+	if err != nil {
+		t.Fatalf("failed to get configs using the workflow: %v", err)
+	}
+	if len(configs) != 1 || configs[0].Metadata.Branch != "master" {
+		t.Errorf("expected the config on master to use the workflow, got %v", configs)
+	}
+	if actual := agent.GetGeneration(); actual != generation {
+		t.Errorf("expected building the component index to keep generation %d, got %d", generation, actual)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if changes != 0 {
+		t.Errorf("expected building the component index not to notify subscribers, got %d calls", changes)
+	}
+}
@@ -0,0 +1,154 @@
+package agents
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// diskCache stores the parsed state of an agent in a file, so that a new agent
+// for the same directories can start from it instead of parsing every file.
+// The state is only used while the directories are at the same git commit.
+type diskCache struct {
+	path     string
+	revision string
+}
+
+// diskCacheEntry is the content of a cache file
+type diskCacheEntry struct {
+	Revision string          `json:"revision"`
+	State    json.RawMessage `json:"state"`
+}
+
+// newDiskCache returns a cache in dir for the state of an agent of the given
+// kind that loads roots. The variant distinguishes agents whose state differs
+// for the same files, like agents with different options. It returns nil if
+// dir is empty or the state of a root cannot be identified by a commit, which
+// is the case for directories outside of git repositories or with changes
+// that are not committed.
+func newDiskCache(dir, kind, variant string, roots ...string) *diskCache {
+	if dir == "" {
+		return nil
+	}
+	key := sha256.New()
+	fmt.Fprintf(key, "%s\n%s\n", kind, variant)
+	var revisions []string
+	for _, root := range roots {
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			logrus.WithError(err).Debugf("Not caching the state of %s", root)
+			return nil
+		}
+		fmt.Fprintln(key, abs)
+		revision, err := cleanRevision(abs)
+		if err != nil {
+			logrus.WithError(err).Debugf("Not caching the state of %s", root)
+			return nil
+		}
+		revisions = append(revisions, revision)
+	}
+	return &diskCache{
+		path:     filepath.Join(dir, fmt.Sprintf("%s-%x.json", kind, key.Sum(nil))),
+		revision: strings.Join(revisions, ","),
+	}
+}
+
+// cleanRevision returns the commit that dir is at, failing if it has changes
+// that are not committed
+func cleanRevision(dir string) (string, error) {
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("'%s' failed with error=%w", cmd.Args, err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	revision, err := git("rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	status, err := git("status", "--porcelain", "--", ".")
+	if err != nil {
+		return "", err
+	}
+	if status != "" {
+		return "", fmt.Errorf("%s has changes that are not committed", dir)
+	}
+	return revision, nil
+}
+
+// load reads the cached state into state and determines whether it was
+// cached for the current commit
+func (c *diskCache) load(state interface{}) bool {
+	if c == nil {
+		return false
+	}
+	raw, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.WithError(err).Warnf("Failed to read cache file %s", c.path)
+		}
+		return false
+	}
+	var entry diskCacheEntry
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		logrus.WithError(err).Warnf("Failed to parse cache file %s", c.path)
+		return false
+	}
+	if entry.Revision != c.revision {
+		return false
+	}
+	if err := json.Unmarshal(entry.State, state); err != nil {
+		logrus.WithError(err).Warnf("Failed to parse state in cache file %s", c.path)
+		return false
+	}
+	return true
+}
+
+// store writes state to the cache for the current commit
+func (c *diskCache) store(state interface{}) {
+	if c == nil {
+		return
+	}
+	if err := c.write(state); err != nil {
+		logrus.WithError(err).Warnf("Failed to write cache file %s", c.path)
+	}
+}
+
+func (c *diskCache) write(state interface{}) error {
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	entry, err := json.Marshal(diskCacheEntry{Revision: c.revision, State: raw})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	// write to a temporary file first so that concurrent readers never see a partial file
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(entry); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
@@ -0,0 +1,103 @@
+package agents
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"unsafe"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/ci-tools/pkg/testhelper"
+)
+
+func TestDiskCache(t *testing.T) {
+	repo, cacheDir := t.TempDir(), t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%s failed: %v, output:\n%s", cmd.Args, err, out)
+		}
+	}
+	write := func(branch string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Join(repo, "org/repo"), 0755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(repo, "org/repo/org-repo.yaml"), testhelper.CIOperatorConfig("org", "repo", branch, "unit"), 0644); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+	}
+	parsed := func() float64 {
+		t.Helper()
+		metric := &dto.Metric{}
+		if err := parseCacheMetric.WithLabelValues("config", "miss").Write(metric); err != nil {
+			t.Fatalf("failed to read metric: %v", err)
+		}
+		return metric.GetCounter().GetValue()
+	}
+	branch := func(agent *configAgent) string {
+		t.Helper()
+		for _, config := range agent.GetAll()["org"]["repo"] {
+			return config.Metadata.Branch
+		}
+		t.Fatal("agent has no config")
+		return ""
+	}
+
+	write("master")
+	git("init", "--quiet")
+	git("add", "-A")
+	git("commit", "--quiet", "-m", "first")
+	if _, err := newConfigAgent(repo, ConfigAgentOptions{CacheDir: cacheDir}); err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(cacheDir, "config-*.json")); len(files) != 1 {
+		t.Fatalf("expected the agent to store its configs in one cache file, got %v", files)
+	}
+
+	before := parsed()
+	agent, err := newConfigAgent(repo, ConfigAgentOptions{CacheDir: cacheDir})
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	if parsed() != before {
+		t.Error("expected an agent for an unchanged commit to load its configs from the cache")
+	}
+	if actual := branch(agent); actual != "master" {
+		t.Errorf("expected cached config for master, got %s", actual)
+	}
+	data := func(s string) uintptr {
+		return (*reflect.StringHeader)(unsafe.Pointer(&s)).Data
+	}
+	if cached := branch(agent); data(agent.interner.String("master")) != data(cached) {
+		t.Error("expected the strings of cached configs to be interned")
+	}
+
+	write("main")
+	agent, err = newConfigAgent(repo, ConfigAgentOptions{CacheDir: cacheDir})
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	if actual := branch(agent); actual != "main" {
+		t.Errorf("expected an agent for a changed checkout to load the configs from disk, got config for %s", actual)
+	}
+
+	git("commit", "--quiet", "-a", "-m", "second")
+	if _, err := newConfigAgent(repo, ConfigAgentOptions{CacheDir: cacheDir}); err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	before = parsed()
+	agent, err = newConfigAgent(repo, ConfigAgentOptions{CacheDir: cacheDir})
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	if parsed() != before || branch(agent) != "main" {
+		t.Error("expected an agent to load the configs of the new commit from the cache")
+	}
+}
@@ -0,0 +1,70 @@
+package agents
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RefCheckout is a shallow checkout of a ref of a git repository in a
+// temporary directory. The config and registry agents created from it share
+// the checkout and do not watch it for changes. Cleanup removes the directory
+// and must be called once none of the agents are used anymore.
+type RefCheckout struct {
+	ref string
+	dir string
+}
+
+// CheckoutRef fetches ref from the git repository at remote with a depth of
+// one into a new temporary directory and checks it out
+func CheckoutRef(remote, ref string) (*RefCheckout, error) {
+	dir, err := ioutil.TempDir("", "agents-ref")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory for %s: %w", ref, err)
+	}
+	c := &RefCheckout{ref: ref, dir: dir}
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"fetch", "--quiet", "--depth", "1", "--", remote, ref},
+		{"checkout", "--quiet", "FETCH_HEAD"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			c.Cleanup()
+			return nil, fmt.Errorf("'%s' failed with error=%w, output:\n%s", cmd.Args, err, out)
+		}
+	}
+	return c, nil
+}
+
+// ConfigAgent returns a ConfigAgent for the configs in configPath, relative to
+// the root of the repository
+func (c *RefCheckout) ConfigAgent(configPath string, opts ...ConfigAgentOption) (ConfigAgent, error) {
+	opt := ConfigAgentOptions{}
+	for _, o := range opts {
+		o(&opt)
+	}
+	return newConfigAgent(filepath.Join(c.dir, configPath), opt)
+}
+
+// RegistryAgent returns a RegistryAgent for the registry in registryPath,
+// relative to the root of the repository
+func (c *RefCheckout) RegistryAgent(registryPath string, opts ...RegistryAgentOption) (RegistryAgent, error) {
+	opt := RegistryAgentOptions{}
+	for _, o := range opts {
+		o(&opt)
+	}
+	return newRegistryAgent(filepath.Join(c.dir, registryPath), opt)
+}
+
+// Cleanup removes the checkout
+func (c *RefCheckout) Cleanup() {
+	if err := os.RemoveAll(c.dir); err != nil {
+		logrus.WithError(err).Warnf("Failed to remove checkout of %s", c.ref)
+	}
+}
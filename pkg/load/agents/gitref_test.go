@@ -0,0 +1,100 @@
+package agents
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/openshift/ci-tools/pkg/api"
+	"github.com/openshift/ci-tools/pkg/testhelper"
+)
+
+func TestAgentsFromRef(t *testing.T) {
+	repo := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%s failed: %v, output:\n%s", cmd.Args, err, out)
+		}
+	}
+	write := func(path string, content []byte) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(repo, path)), 0755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(repo, path), content, 0644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+	registry := "../../../test/multistage-registry/registry"
+	if err := filepath.WalkDir(registry, func(path string, info fs.DirEntry, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(registry, path)
+		if err != nil {
+			return err
+		}
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		write(filepath.Join("registry", rel), raw)
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to copy registry: %v", err)
+	}
+
+	git("init", "--quiet")
+	write("config/org/repo/org-repo-master.yaml", testhelper.CIOperatorConfig("org", "repo", "master", "unit"))
+	git("add", "-A")
+	git("commit", "--quiet", "-m", "first")
+	git("tag", "first")
+	write("config/org/repo/org-repo-release-4.9.yaml", testhelper.CIOperatorConfig("org", "repo", "release-4.9", "unit"))
+	git("add", "-A")
+	git("commit", "--quiet", "-m", "second")
+
+	checkout, err := CheckoutRef(repo, "first")
+	if err != nil {
+		t.Fatalf("failed to check out ref: %v", err)
+	}
+	defer checkout.Cleanup()
+	configAgent, err := checkout.ConfigAgent("config")
+	if err != nil {
+		t.Fatalf("failed to create config agent: %v", err)
+	}
+	var branches []string
+	for _, config := range configAgent.GetAll()["org"]["repo"] {
+		branches = append(branches, config.Metadata.Branch)
+	}
+	if diff := cmp.Diff([]string{"master"}, branches); diff != "" {
+		t.Errorf("expected configs as of the ref, diff: %v", diff)
+	}
+
+	registryAgent, err := checkout.RegistryAgent("registry")
+	if err != nil {
+		t.Fatalf("failed to create registry agent: %v", err)
+	}
+	workflow := "ipi"
+	if _, err := registryAgent.Resolve("e2e", api.MultiStageTestConfiguration{Workflow: &workflow}); err != nil {
+		t.Errorf("failed to resolve with registry from ref: %v", err)
+	}
+
+	if _, err := CheckoutRef(repo, "missing"); err == nil {
+		t.Error("expected checking out a missing ref to fail")
+	}
+	// without the separator, the ref would be taken as an option of git fetch
+	if _, err := CheckoutRef(repo, "--upload-pack=touch "+filepath.Join(repo, "injected")); err == nil {
+		t.Error("expected checking out a ref that looks like an option to fail")
+	}
+	if _, err := os.Stat(filepath.Join(repo, "injected")); !os.IsNotExist(err) {
+		t.Errorf("expected the ref not to be taken as an option, got %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package agents
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+
+	"github.com/openshift/ci-tools/pkg/api"
+	"github.com/openshift/ci-tools/pkg/load"
+	"github.com/openshift/ci-tools/pkg/registry"
+)
+
+// lazyCreateRetryPeriod is how long a lazy config agent returns the error of
+// a failed creation before it tries to create the agent again
+const lazyCreateRetryPeriod = 30 * time.Second
+
+// lazyConfigAgent is a ConfigAgent that creates the agent it delegates to when
+// it is used for the first time
+type lazyConfigAgent struct {
+	lock   sync.Mutex
+	create func() (ConfigAgent, error)
+	agent  ConfigAgent
+	// pending holds the callbacks that were subscribed before the agent was
+	// created, which are subscribed once it is
+	pending []func(ConfigChange)
+	// err is the error of the last failed creation, which is returned until
+	// retryAt instead of trying to create the agent on every call
+	err     error
+	retryAt time.Time
+	now     func() time.Time
+}
+
+// NewLazyConfigAgent returns a ConfigAgent like NewConfigAgent does, but does
+// not load the configs until one of its methods is called for the first time.
+// This avoids the cost of loading all configs for users that may never need
+// them. If creating the agent fails, methods that return an error return that
+// error and the others return empty values, and calls after a retry period
+// try to create the agent again.
+func NewLazyConfigAgent(configPath string, opts ...ConfigAgentOption) ConfigAgent {
+	return &lazyConfigAgent{
+		create: func() (ConfigAgent, error) {
+			return NewConfigAgent(configPath, opts...)
+		},
+		now: time.Now,
+	}
+}
+
+// get returns the agent, creating it if it was not created yet
+func (a *lazyConfigAgent) get() (ConfigAgent, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.getLocked()
+}
+
+func (a *lazyConfigAgent) getLocked() (ConfigAgent, error) {
+	if a.agent != nil {
+		return a.agent, nil
+	}
+	if a.err != nil && a.now().Before(a.retryAt) {
+		return nil, a.err
+	}
+	agent, err := a.create()
+	if err != nil {
+		a.err = fmt.Errorf("failed to create config agent: %w", err)
+		a.retryAt = a.now().Add(lazyCreateRetryPeriod)
+		logrus.WithError(a.err).Error("Failed to create config agent")
+		return nil, a.err
+	}
+	for _, callback := range a.pending {
+		agent.Subscribe(callback)
+	}
+	a.agent, a.pending, a.err = agent, nil, nil
+	return agent, nil
+}
+
+func (a *lazyConfigAgent) GetMatchingConfig(metadata api.Metadata) (api.ReleaseBuildConfiguration, error) {
+	agent, err := a.get()
+	if err != nil {
+		return api.ReleaseBuildConfiguration{}, err
+	}
+	return agent.GetMatchingConfig(metadata)
+}
+
+func (a *lazyConfigAgent) GetAll() load.ByOrgRepo {
+	agent, err := a.get()
+	if err != nil {
+		return nil
+	}
+	return agent.GetAll()
+}
+
+func (a *lazyConfigAgent) Search(query api.Metadata) []api.Metadata {
+	agent, err := a.get()
+	if err != nil {
+		return nil
+	}
+	return agent.Search(query)
+}
+
+func (a *lazyConfigAgent) GetGeneration() int {
+	agent, err := a.get()
+	if err != nil {
+		return 0
+	}
+	return agent.GetGeneration()
+}
+
+func (a *lazyConfigAgent) AddIndex(indexName string, indexFunc IndexFn) error {
+	agent, err := a.get()
+	if err != nil {
+		return err
+	}
+	return agent.AddIndex(indexName, indexFunc)
+}
+
+func (a *lazyConfigAgent) GetFromIndex(indexName string, indexKey string) ([]*api.ReleaseBuildConfiguration, error) {
+	agent, err := a.get()
+	if err != nil {
+		return nil, err
+	}
+	return agent.GetFromIndex(indexName, indexKey)
+}
+
+func (a *lazyConfigAgent) SubscribeToIndexChanges(indexName string) (<-chan IndexDelta, error) {
+	agent, err := a.get()
+	if err != nil {
+		return nil, err
+	}
+	return agent.SubscribeToIndexChanges(indexName)
+}
+
+func (a *lazyConfigAgent) SetOverlay(path string, content []byte) error {
+	agent, err := a.get()
+	if err != nil {
+		return err
+	}
+	return agent.SetOverlay(path, content)
+}
+
+func (a *lazyConfigAgent) RemoveOverlay(path string) error {
+	agent, err := a.get()
+	if err != nil {
+		return err
+	}
+	return agent.RemoveOverlay(path)
+}
+
+// Subscribe does not create the agent, but subscribes the callback once the
+// agent is created
+func (a *lazyConfigAgent) Subscribe(callback func(ConfigChange)) {
+	a.lock.Lock()
+	agent := a.agent
+	if agent == nil {
+		a.pending = append(a.pending, callback)
+	}
+	a.lock.Unlock()
+	if agent != nil {
+		agent.Subscribe(callback)
+	}
+}
+
+func (a *lazyConfigAgent) ReloadPaths(paths []string) error {
+	agent, err := a.get()
+	if err != nil {
+		return err
+	}
+	return agent.ReloadPaths(paths)
+}
+
+func (a *lazyConfigAgent) Node(path string) (*yaml.Node, error) {
+	agent, err := a.get()
+	if err != nil {
+		return nil, err
+	}
+	return agent.Node(path)
+}
+
+func (a *lazyConfigAgent) LoadErrors() []*load.FileError {
+	agent, err := a.get()
+	if err != nil {
+		return nil
+	}
+	return agent.LoadErrors()
+}
+
+func (a *lazyConfigAgent) GetConfigsUsingComponent(name string, kind registry.Type) ([]*api.ReleaseBuildConfiguration, error) {
+	agent, err := a.get()
+	if err != nil {
+		return nil, err
+	}
+	return agent.GetConfigsUsingComponent(name, kind)
+}
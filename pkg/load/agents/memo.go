@@ -0,0 +1,159 @@
+package agents
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+
+	"github.com/openshift/ci-tools/pkg/api"
+	"github.com/openshift/ci-tools/pkg/registry"
+)
+
+// maxMemoizedTests is the number of resolved tests a memo holds at most. Tests
+// are keyed by their whole configuration, so every edit of a test adds one.
+// The least recently used tests are dropped first.
+const maxMemoizedTests = 1000
+
+// resolutionMemo holds the chains, workflows and tests that were resolved and
+// the metadata that was collected at one generation of a registry agent.
+// Reloads replace it, which invalidates everything in it at once. Every entry
+// is computed once; the lock only guards the map, so different entries are
+// computed concurrently. The values it returns are shared between callers.
+type resolutionMemo struct {
+	lock    sync.Mutex
+	entries map[memoKey]*memoEntry
+	// tests holds the keys of the resolved tests in entries, most recently
+	// used first
+	tests *list.List
+}
+
+// memoKey names what an entry holds, like "chain" and the name of a chain or
+// "test" and the name and serialized configuration of a test
+type memoKey struct {
+	kind string
+	name string
+}
+
+// isTest determines whether the entry holds a resolved test, of which the
+// memo holds a limited number
+func (k memoKey) isTest() bool {
+	return k.kind == "test" || k.kind == "test/provenance"
+}
+
+type memoEntry struct {
+	once  sync.Once
+	value interface{}
+	err   error
+	// element is the element of the entry in the tests of the memo, if any
+	element *list.Element
+}
+
+type resolvedTest struct {
+	test       api.MultiStageTestConfigurationLiteral
+	provenance registry.Provenance
+}
+
+func newResolutionMemo() *resolutionMemo {
+	return &resolutionMemo{entries: map[memoKey]*memoEntry{}, tests: list.New()}
+}
+
+// get returns the value computed earlier for key or computes it with compute.
+// Callers that ask for the same key while it is computed wait for the result.
+func (m *resolutionMemo) get(key memoKey, compute func() (interface{}, error)) (interface{}, error) {
+	m.lock.Lock()
+	entry, ok := m.entries[key]
+	if !ok {
+		entry = &memoEntry{}
+		m.entries[key] = entry
+		if key.isTest() {
+			entry.element = m.tests.PushFront(key)
+			if m.tests.Len() > maxMemoizedTests {
+				oldest := m.tests.Remove(m.tests.Back()).(memoKey)
+				delete(m.entries, oldest)
+			}
+		}
+	} else if entry.element != nil {
+		m.tests.MoveToFront(entry.element)
+	}
+	m.lock.Unlock()
+	entry.once.Do(func() {
+		entry.value, entry.err = compute()
+	})
+	return entry.value, entry.err
+}
+
+// chain returns the chain resolved earlier or resolves it with resolve. A nil
+// memo resolves every time.
+func (m *resolutionMemo) chain(name string, resolve func() ([]api.LiteralTestStep, error)) ([]api.LiteralTestStep, error) {
+	if m == nil {
+		return resolve()
+	}
+	steps, err := m.get(memoKey{kind: "chain", name: name}, func() (interface{}, error) {
+		return resolve()
+	})
+	return steps.([]api.LiteralTestStep), err
+}
+
+// workflow returns the workflow resolved earlier or resolves it with resolve.
+// A nil memo resolves every time.
+func (m *resolutionMemo) workflow(name string, resolve func() (api.MultiStageTestConfigurationLiteral, error)) (api.MultiStageTestConfigurationLiteral, error) {
+	if m == nil {
+		return resolve()
+	}
+	workflow, err := m.get(memoKey{kind: "workflow", name: name}, func() (interface{}, error) {
+		return resolve()
+	})
+	return workflow.(api.MultiStageTestConfigurationLiteral), err
+}
+
+// componentMetadata returns the metadata collected earlier or collects it with
+// collect. A nil memo collects every time.
+func (m *resolutionMemo) componentMetadata(name string, kind registry.Type, collect func() (ComponentMetadata, error)) (ComponentMetadata, error) {
+	if m == nil {
+		return collect()
+	}
+	metadata, err := m.get(memoKey{kind: "metadata/" + kind.String(), name: name}, func() (interface{}, error) {
+		return collect()
+	})
+	return metadata.(ComponentMetadata), err
+}
+
+// testKey returns the name under which a test is memoized. The serialized
+// configuration identifies the test, as tests of configs and their edited
+// versions may share a name but differ otherwise.
+func testKey(name string, config api.MultiStageTestConfiguration) (string, bool) {
+	raw, err := json.Marshal(config)
+	if err != nil {
+		return "", false
+	}
+	return name + "\x00" + string(raw), true
+}
+
+// test returns the test resolved earlier with the same name and configuration
+// or resolves it with resolve. A nil memo resolves every time.
+func (m *resolutionMemo) test(name string, config api.MultiStageTestConfiguration, resolve func() (api.MultiStageTestConfigurationLiteral, error)) (api.MultiStageTestConfigurationLiteral, error) {
+	key, ok := testKey(name, config)
+	if m == nil || !ok {
+		return resolve()
+	}
+	test, err := m.get(memoKey{kind: "test", name: key}, func() (interface{}, error) {
+		return resolve()
+	})
+	return test.(api.MultiStageTestConfigurationLiteral), err
+}
+
+// testWithProvenance returns the test and its provenance resolved earlier with
+// the same name and configuration or resolves them with resolve. They are
+// memoized apart from the tests without provenance, which are cheaper to
+// resolve. A nil memo resolves every time.
+func (m *resolutionMemo) testWithProvenance(name string, config api.MultiStageTestConfiguration, resolve func() (api.MultiStageTestConfigurationLiteral, registry.Provenance, error)) (api.MultiStageTestConfigurationLiteral, registry.Provenance, error) {
+	key, ok := testKey(name, config)
+	if m == nil || !ok {
+		return resolve()
+	}
+	resolved, err := m.get(memoKey{kind: "test/provenance", name: key}, func() (interface{}, error) {
+		test, provenance, err := resolve()
+		return resolvedTest{test: test, provenance: provenance}, err
+	})
+	return resolved.(resolvedTest).test, resolved.(resolvedTest).provenance, err
+}
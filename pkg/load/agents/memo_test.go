@@ -0,0 +1,93 @@
+package agents
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/openshift/ci-tools/pkg/api"
+	"github.com/openshift/ci-tools/pkg/registry"
+)
+
+func TestResolutionMemo(t *testing.T) {
+	memo := newResolutionMemo()
+
+	// resolving one chain must not block resolving another one
+	started, unblock := make(chan struct{}), make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := memo.chain("slow", func() ([]api.LiteralTestStep, error) {
+			close(started)
+			<-unblock
+			return nil, nil
+		}); err != nil {
+			t.Errorf("failed to resolve chain: %v", err)
+		}
+	}()
+	<-started
+	if _, err := memo.chain("fast", func() ([]api.LiteralTestStep, error) { return nil, nil }); err != nil {
+		t.Errorf("failed to resolve chain: %v", err)
+	}
+	close(unblock)
+	wg.Wait()
+
+	resolutions := 0
+	resolve := func() (api.MultiStageTestConfigurationLiteral, error) {
+		resolutions++
+		return api.MultiStageTestConfigurationLiteral{}, nil
+	}
+	workflow := "ipi"
+	for i := 0; i < 2; i++ {
+		if _, err := memo.test("e2e", api.MultiStageTestConfiguration{Workflow: &workflow}, resolve); err != nil {
+			t.Fatalf("failed to resolve test: %v", err)
+		}
+	}
+	if resolutions != 1 {
+		t.Errorf("expected a test to be resolved once, got %d resolutions", resolutions)
+	}
+	if _, err := memo.test("e2e", api.MultiStageTestConfiguration{}, resolve); err != nil {
+		t.Fatalf("failed to resolve test: %v", err)
+	}
+	if resolutions != 2 {
+		t.Errorf("expected a test with a different configuration to be resolved again, got %d resolutions", resolutions)
+	}
+	provenanceResolutions := 0
+	for i := 0; i < 2; i++ {
+		if _, _, err := memo.testWithProvenance("e2e", api.MultiStageTestConfiguration{Workflow: &workflow}, func() (api.MultiStageTestConfigurationLiteral, registry.Provenance, error) {
+			provenanceResolutions++
+			return api.MultiStageTestConfigurationLiteral{}, nil, nil
+		}); err != nil {
+			t.Fatalf("failed to resolve test: %v", err)
+		}
+	}
+	if provenanceResolutions != 1 {
+		t.Errorf("expected a test with provenance to be resolved once, got %d resolutions", provenanceResolutions)
+	}
+
+	for i := 0; i < maxMemoizedTests; i++ {
+		if _, err := memo.test("e2e", api.MultiStageTestConfiguration{Environment: api.TestEnvironment{"INDEX": strconv.Itoa(i)}}, resolve); err != nil {
+			t.Fatalf("failed to resolve test: %v", err)
+		}
+		// the test that is used all the time is never dropped
+		if _, err := memo.test("e2e", api.MultiStageTestConfiguration{Workflow: &workflow}, resolve); err != nil {
+			t.Fatalf("failed to resolve test: %v", err)
+		}
+	}
+	if memo.tests.Len() > maxMemoizedTests {
+		t.Errorf("expected at most %d memoized tests, got %d", maxMemoizedTests, memo.tests.Len())
+	}
+	if resolutions != 2+maxMemoizedTests {
+		t.Errorf("expected the most recently used test to stay memoized, got %d resolutions", resolutions)
+	}
+	if _, err := memo.test("e2e", api.MultiStageTestConfiguration{}, resolve); err != nil {
+		t.Fatalf("failed to resolve test: %v", err)
+	}
+	if resolutions != 3+maxMemoizedTests {
+		t.Errorf("expected the least recently used test to be dropped, got %d resolutions", resolutions)
+	}
+	if _, ok := memo.entries[memoKey{kind: "chain", name: "slow"}]; !ok {
+		t.Error("expected dropping tests to keep the resolved chains")
+	}
+}
@@ -0,0 +1,174 @@
+package agents
+
+import (
+	"fmt"
+
+	"github.com/openshift/ci-tools/pkg/api"
+	"github.com/openshift/ci-tools/pkg/registry"
+)
+
+// ComponentMetadata describes what a registry component and the steps below it
+// declare. Every declaration records the component it comes from, named by its
+// kind and name like "reference/ipi-install-install".
+type ComponentMetadata struct {
+	// Component is the kind and name of the component
+	Component string
+	// Path is the file that defines the component, if it is known
+	Path          string
+	Documentation string
+	// Parameters are the parameters of the steps, in the order in which they
+	// are first declared. Parameters that a chain declares or a workflow sets
+	// take the default and source of the outermost such component.
+	Parameters   []ParameterMetadata
+	Dependencies []DependencyMetadata
+	Credentials  []CredentialMetadata
+	Leases       []LeaseMetadata
+}
+
+// ParameterMetadata is a parameter and the component that declares it
+type ParameterMetadata struct {
+	api.StepParameter
+	Source string
+}
+
+// DependencyMetadata is a dependency and the component that declares it
+type DependencyMetadata struct {
+	api.StepDependency
+	Source string
+}
+
+// CredentialMetadata is a credential and the component that declares it
+type CredentialMetadata struct {
+	api.CredentialReference
+	Source string
+}
+
+// LeaseMetadata is a lease and the component that declares it
+type LeaseMetadata struct {
+	api.StepLease
+	Source string
+}
+
+// ComponentMetadata returns what the reference, chain or workflow with the
+// given name and the steps below it declare
+func (s *RegistrySnapshot) ComponentMetadata(name string, kind registry.Type) (ComponentMetadata, error) {
+	return s.memo.componentMetadata(name, kind, func() (ComponentMetadata, error) {
+		return s.collectMetadata(name, kind)
+	})
+}
+
+func (s *RegistrySnapshot) collectMetadata(name string, kind registry.Type) (ComponentMetadata, error) {
+	c := metadataCollector{snapshot: s, parameters: map[string]int{}}
+	var component string
+	switch kind {
+	case registry.Reference:
+		if _, ok := s.references[name]; !ok {
+			return ComponentMetadata{}, fmt.Errorf("no %s named %s", kind, name)
+		}
+		component = "reference/" + name
+		c.addReference(name)
+	case registry.Chain:
+		if _, ok := s.chains[name]; !ok {
+			return ComponentMetadata{}, fmt.Errorf("no %s named %s", kind, name)
+		}
+		component = "chain/" + name
+		c.addChain(name)
+	case registry.Workflow:
+		workflow, ok := s.workflows[name]
+		if !ok {
+			return ComponentMetadata{}, fmt.Errorf("no %s named %s", kind, name)
+		}
+		component = "workflow/" + name
+		c.addWorkflow(component, workflow)
+	default:
+		return ComponentMetadata{}, fmt.Errorf("unknown registry component type %s", kind)
+	}
+	c.metadata.Component = component
+	c.metadata.Path = s.paths[component]
+	c.metadata.Documentation = s.documentation[name]
+	return c.metadata, nil
+}
+
+// metadataCollector gathers the declarations of a component, outermost
+// components first
+type metadataCollector struct {
+	snapshot *RegistrySnapshot
+	metadata ComponentMetadata
+	// parameters holds the index of each collected parameter by name
+	parameters map[string]int
+}
+
+func (c *metadataCollector) addParameter(parameter api.StepParameter, source string) {
+	if _, seen := c.parameters[parameter.Name]; seen {
+		return
+	}
+	c.parameters[parameter.Name] = len(c.metadata.Parameters)
+	c.metadata.Parameters = append(c.metadata.Parameters, ParameterMetadata{StepParameter: parameter, Source: source})
+}
+
+func (c *metadataCollector) addLeases(leases []api.StepLease, source string) {
+	for _, lease := range leases {
+		c.metadata.Leases = append(c.metadata.Leases, LeaseMetadata{StepLease: lease, Source: source})
+	}
+}
+
+func (c *metadataCollector) addWorkflow(source string, workflow api.MultiStageTestConfiguration) {
+	c.addLeases(workflow.Leases, source)
+	for _, steps := range [][]api.TestStep{workflow.Pre, workflow.Test, workflow.Post} {
+		c.addSteps(steps, source)
+	}
+	// the workflow sets the values of parameters and dependencies of its steps
+	for name, value := range workflow.Environment {
+		if i, ok := c.parameters[name]; ok {
+			value := value
+			c.metadata.Parameters[i].Default = &value
+			c.metadata.Parameters[i].Source = source
+		}
+	}
+	for i, dependency := range c.metadata.Dependencies {
+		if name, ok := workflow.Dependencies[dependency.Env]; ok {
+			c.metadata.Dependencies[i].Name = name
+			c.metadata.Dependencies[i].Source = source
+		}
+	}
+}
+
+func (c *metadataCollector) addChain(name string) {
+	chain := c.snapshot.chains[name]
+	source := "chain/" + name
+	for _, parameter := range chain.Environment {
+		c.addParameter(parameter, source)
+	}
+	c.addLeases(chain.Leases, source)
+	c.addSteps(chain.Steps, source)
+}
+
+func (c *metadataCollector) addReference(name string) {
+	c.addLiteral(c.snapshot.references[name], "reference/"+name)
+}
+
+func (c *metadataCollector) addSteps(steps []api.TestStep, owner string) {
+	for _, step := range steps {
+		switch {
+		case step.Reference != nil:
+			c.addReference(*step.Reference)
+		case step.Chain != nil:
+			c.addChain(*step.Chain)
+		case step.LiteralTestStep != nil:
+			c.addLiteral(*step.LiteralTestStep, owner)
+		}
+	}
+}
+
+func (c *metadataCollector) addLiteral(step api.LiteralTestStep, source string) {
+	for _, parameter := range step.Environment {
+		c.addParameter(parameter, source)
+	}
+	for _, dependency := range step.Dependencies {
+		c.metadata.Dependencies = append(c.metadata.Dependencies, DependencyMetadata{StepDependency: dependency, Source: source})
+	}
+	for _, credential := range step.Credentials {
+		c.metadata.Credentials = append(c.metadata.Credentials, CredentialMetadata{CredentialReference: credential, Source: source})
+	}
+	c.addLeases(step.Leases, source)
+}
@@ -0,0 +1,98 @@
+package agents
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/openshift/ci-tools/pkg/api"
+	"github.com/openshift/ci-tools/pkg/registry"
+)
+
+func TestComponentMetadata(t *testing.T) {
+	stringPtr := func(s string) *string { return &s }
+	install, chain := "install", "install-chain"
+	snapshot := &RegistrySnapshot{
+		references: registry.ReferenceByName{
+			"install": {
+				As:           "install",
+				Environment:  []api.StepParameter{{Name: "SIZE", Default: stringPtr("small"), Documentation: "size of the cluster"}, {Name: "REGION", Documentation: "region of the cluster"}},
+				Dependencies: []api.StepDependency{{Name: "installer", Env: "INSTALLER"}},
+				Credentials:  []api.CredentialReference{{Namespace: "test-credentials", Name: "cloud", MountPath: "/var/run/cloud"}},
+				Leases:       []api.StepLease{{ResourceType: "aws-quota-slice", Env: "LEASED_RESOURCE"}},
+			},
+		},
+		chains: registry.ChainByName{
+			"install-chain": {
+				As: "install-chain",
+				Steps: []api.TestStep{
+					{Reference: &install},
+					{LiteralTestStep: &api.LiteralTestStep{As: "check", Environment: []api.StepParameter{{Name: "TIMEOUT"}}}},
+				},
+				Environment: []api.StepParameter{{Name: "SIZE", Default: stringPtr("large")}},
+			},
+		},
+		workflows: registry.WorkflowByName{
+			"workflow": {
+				Pre:          []api.TestStep{{Chain: &chain}},
+				Environment:  api.TestEnvironment{"REGION": "us-east-1"},
+				Dependencies: api.TestDependencies{"INSTALLER": "custom-installer"},
+			},
+		},
+		documentation: map[string]string{"workflow": "Installs a cluster."},
+		paths:         map[string]string{"workflow/workflow": "workflow/workflow-workflow.yaml"},
+	}
+
+	testCases := []struct {
+		name     string
+		kind     registry.Type
+		expected ComponentMetadata
+	}{
+		{
+			name: "install",
+			kind: registry.Reference,
+			expected: ComponentMetadata{
+				Component: "reference/install",
+				Parameters: []ParameterMetadata{
+					{StepParameter: api.StepParameter{Name: "SIZE", Default: stringPtr("small"), Documentation: "size of the cluster"}, Source: "reference/install"},
+					{StepParameter: api.StepParameter{Name: "REGION", Documentation: "region of the cluster"}, Source: "reference/install"},
+				},
+				Dependencies: []DependencyMetadata{{StepDependency: api.StepDependency{Name: "installer", Env: "INSTALLER"}, Source: "reference/install"}},
+				Credentials:  []CredentialMetadata{{CredentialReference: api.CredentialReference{Namespace: "test-credentials", Name: "cloud", MountPath: "/var/run/cloud"}, Source: "reference/install"}},
+				Leases:       []LeaseMetadata{{StepLease: api.StepLease{ResourceType: "aws-quota-slice", Env: "LEASED_RESOURCE"}, Source: "reference/install"}},
+			},
+		},
+		{
+			name: "workflow",
+			kind: registry.Workflow,
+			expected: ComponentMetadata{
+				Component:     "workflow/workflow",
+				Path:          "workflow/workflow-workflow.yaml",
+				Documentation: "Installs a cluster.",
+				Parameters: []ParameterMetadata{
+					{StepParameter: api.StepParameter{Name: "SIZE", Default: stringPtr("large")}, Source: "chain/install-chain"},
+					{StepParameter: api.StepParameter{Name: "REGION", Default: stringPtr("us-east-1"), Documentation: "region of the cluster"}, Source: "workflow/workflow"},
+					{StepParameter: api.StepParameter{Name: "TIMEOUT"}, Source: "chain/install-chain"},
+				},
+				Dependencies: []DependencyMetadata{{StepDependency: api.StepDependency{Name: "custom-installer", Env: "INSTALLER"}, Source: "workflow/workflow"}},
+				Credentials:  []CredentialMetadata{{CredentialReference: api.CredentialReference{Namespace: "test-credentials", Name: "cloud", MountPath: "/var/run/cloud"}, Source: "reference/install"}},
+				Leases:       []LeaseMetadata{{StepLease: api.StepLease{ResourceType: "aws-quota-slice", Env: "LEASED_RESOURCE"}, Source: "reference/install"}},
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			actual, err := snapshot.ComponentMetadata(testCase.name, testCase.kind)
+			if err != nil {
+				t.Fatalf("failed to get metadata: %v", err)
+			}
+			if diff := cmp.Diff(testCase.expected, actual); diff != "" {
+				t.Errorf("unexpected metadata, diff: %v", diff)
+			}
+		})
+	}
+
+	if _, err := snapshot.ComponentMetadata("missing", registry.Chain); err == nil {
+		t.Error("expected getting the metadata of a missing chain to fail")
+	}
+}
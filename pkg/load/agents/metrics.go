@@ -0,0 +1,23 @@
+package agents
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var loadedEntriesMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "configresolver_agent_loaded_entries",
+		Help: "number of configs or registry components loaded by the agent in its last reload",
+	},
+	[]string{"agent", "path"},
+)
+
+func init() {
+	prometheus.MustRegister(loadedEntriesMetric)
+}
+
+// recordLoad records the number of entries an agent loaded from path, which
+// are the configs of the config agent and the components of the registry
+// agent. The agent is either "config" or "registry"; the path tells apart
+// agents of the same kind in one process.
+func recordLoad(agent, path string, entries int) {
+	loadedEntriesMetric.With(prometheus.Labels{"agent": agent, "path": path}).Set(float64(entries))
+}
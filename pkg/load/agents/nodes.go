@@ -0,0 +1,69 @@
+package agents
+
+import (
+	"fmt"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/openshift/ci-tools/pkg/load"
+)
+
+// nodeIndex holds the YAML nodes of the files loaded by an agent. Nodes carry
+// the line and column of every key and value, so that exact ranges can be
+// determined without parsing the file again. Files are parsed on first access
+// and kept until they are reloaded, unless the index is transient.
+type nodeIndex struct {
+	lock  sync.Mutex
+	nodes map[string]*yaml.Node
+	// transient determines whether files are parsed on every access instead
+	// of keeping their nodes, which hold the whole content of the files
+	transient bool
+}
+
+// get returns the document node for path, parsing it from the overlay or disk
+// if it is not in the index yet
+func (i *nodeIndex) get(path string, overlay load.Overlay) (*yaml.Node, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if node, ok := i.nodes[path]; ok {
+		return node, nil
+	}
+	raw, err := overlay.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	node := &yaml.Node{}
+	if err := yaml.Unmarshal(raw, node); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if i.transient {
+		return node, nil
+	}
+	if i.nodes == nil {
+		i.nodes = map[string]*yaml.Node{}
+	}
+	i.nodes[path] = node
+	return node, nil
+}
+
+// invalidate drops the nodes of all files at or below the given paths
+func (i *nodeIndex) invalidate(paths []string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	for path := range i.nodes {
+		for _, invalidated := range paths {
+			if isUnder(invalidated, path) {
+				delete(i.nodes, path)
+				break
+			}
+		}
+	}
+}
+
+// reset drops all nodes
+func (i *nodeIndex) reset() {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.nodes = nil
+}
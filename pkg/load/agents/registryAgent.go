@@ -2,12 +2,15 @@ package agents
 
 import (
 	"fmt"
+	"reflect"
 	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
 
+	"k8s.io/apimachinery/pkg/util/sets"
 	utilpointer "k8s.io/utils/pointer"
 
 	"github.com/openshift/ci-tools/pkg/api"
@@ -15,27 +18,119 @@ import (
 	"github.com/openshift/ci-tools/pkg/registry"
 )
 
+// RegistryChange summarizes the changes to the registry in one reload of a RegistryAgent
+type RegistryChange struct {
+	// Generation is the generation of the agent after the reload
+	Generation int
+	References ChangedNames
+	Chains     ChangedNames
+	Workflows  ChangedNames
+	Observers  ChangedNames
+}
+
+// FieldSource describes the registry component that set a field of a resolved test
+type FieldSource struct {
+	// Component is the kind and name of the component, like "chain/ipi-install"
+	Component string
+	// Path is the file that defines the component. It is empty for fields
+	// that were set by the test itself.
+	Path string
+}
+
+// ChangedNames holds the sorted names of added, changed and removed items
+type ChangedNames struct {
+	Added   []string
+	Changed []string
+	Removed []string
+}
+
 // RegistryAgent is an interface that can load a registry from disk into
 // memory and resolve ReleaseBuildConfigurations using the registry
 type RegistryAgent interface {
 	ResolveConfig(config api.ReleaseBuildConfiguration) (api.ReleaseBuildConfiguration, error)
 	GetRegistryComponents() (registry.ReferenceByName, registry.ChainByName, registry.WorkflowByName, map[string]string, api.RegistryMetadata)
+	// GetRegistryContent returns all components of the registry, including observers
+	GetRegistryContent() RegistryContent
 	GetGeneration() int
+	// SetOverlay makes the agent use content instead of the file at path, which
+	// does not need to exist on disk, until the overlay is removed again.
+	SetOverlay(path string, content []byte) error
+	// RemoveOverlay makes the agent use the file at path from disk again.
+	RemoveOverlay(path string) error
+	// WhoReferences returns the chains, workflows and configs that directly
+	// reference the registry component with the given name and type. Configs
+	// are only included if the agent was created with a ConfigAgent. Transitive
+	// users can be found through the Ancestors of the returned components.
+	WhoReferences(name string, kind registry.Type) (References, error)
+	// Subscribe registers a callback that is called with a summary of the changes
+	// after every reload of the agent. Callbacks are called sequentially after the
+	// reload finished and should not block.
+	Subscribe(callback func(RegistryChange))
+	// ReloadPaths reloads the registry files at or below the given paths, which
+	// may have been added, changed or removed, without reloading any other files.
+	ReloadPaths(paths []string) error
+	// ResolveTest resolves a single multi-stage test and returns the source of
+	// every field of the result, keyed by the field as in registry.Provenance.
+	ResolveTest(name string, config api.MultiStageTestConfiguration) (api.MultiStageTestConfigurationLiteral, map[string]FieldSource, error)
+	// Node returns the parsed YAML document of the file at path, which holds
+	// the line and column of every key and value in the file.
+	Node(path string) (*yaml.Node, error)
+	// ComponentMetadata returns the parameters, dependencies, credentials and
+	// leases that the reference, chain or workflow with the given name and the
+	// steps below it declare. The metadata is collected once per generation and
+	// shared between callers, so it must not be modified.
+	ComponentMetadata(name string, kind registry.Type) (ComponentMetadata, error)
+	// Snapshot returns an immutable view of the current registry, which stays
+	// consistent while the agent reloads.
+	Snapshot() *RegistrySnapshot
+	// LoadErrors returns the errors of the files that an agent created with
+	// WithRegistryPartialLoad failed to load, sorted by path.
+	LoadErrors() []*load.FileError
 	registry.Resolver
 }
 
 type registryAgent struct {
-	lock          *sync.RWMutex
-	resolver      registry.Resolver
-	registryPath  string
+	lock     *sync.RWMutex
+	resolver registry.ComponentResolver
+	// memo holds what was resolved at the current generation
+	memo         *resolutionMemo
+	registryPath string
+	layers       []string
+	lowMemory    bool
+	// partial determines whether the agent loads the valid files when others
+	// fail to load
+	partial bool
+	// interner deduplicates the strings of the components, like the step
+	// names, images and parameters that repeat across many components
+	interner      *load.Interner
 	generation    int
 	errorMetrics  *prometheus.CounterVec
 	flags         load.RegistryFlag
+	files         *load.RegistryFiles
 	references    registry.ReferenceByName
 	chains        registry.ChainByName
 	workflows     registry.WorkflowByName
+	observers     registry.ObserverByName
 	documentation map[string]string
 	metadata      api.RegistryMetadata
+	graph         registry.NodeByName
+	paths         map[string]string
+	overlay       load.Overlay
+	nodes         nodeIndex
+	subscribers   []func(RegistryChange)
+	// remote is the address of the configresolver the agent loads from, if any
+	remote string
+	// configs holds the configs that WhoReferences includes, if any
+	configs ConfigAgent
+}
+
+// References holds what directly references a registry component
+type References struct {
+	// Components holds the chains and workflows, sorted by type and name
+	Components []registry.Node
+	// Configs holds the configs with tests that use the component, sorted by
+	// their metadata
+	Configs []*api.ReleaseBuildConfiguration
 }
 
 var registryReloadTimeMetric = prometheus.NewHistogram(
@@ -57,6 +152,29 @@ type RegistryAgentOptions struct {
 	// FlatRegistry describes if the registry is flat, which means org/repo/branch info can not be inferred
 	// from the filepath. Defaults to true.
 	FlatRegistry *bool
+	// Layers holds the paths of registries that are layered over the registry,
+	// in increasing priority. Their components replace the components with the
+	// same name in the registry and the layers before them.
+	Layers []string
+	// CacheDir is a directory in which the agent stores the loaded registry.
+	// A new agent loads it from there instead of parsing the registry if it is
+	// in a git repository that is still at the same commit.
+	CacheDir string
+	// LowMemory makes the agent use less memory at the cost of loading and
+	// parsing files more often: it does not keep parsed files or YAML
+	// documents to reuse them.
+	LowMemory bool
+	// PartialLoad makes the agent load the valid files when others fail to
+	// load instead of failing. The errors are available from LoadErrors.
+	PartialLoad bool
+	// Watch makes NewRegistryAgent reload only the files that change on disk
+	// instead of the whole registry. Unless PollInterval is zero, the whole
+	// registry is also reloaded at that interval.
+	Watch        bool
+	PollInterval time.Duration
+	// ConfigAgent holds the configs that WhoReferences includes next to the
+	// components of the registry.
+	ConfigAgent ConfigAgent
 }
 
 type RegistryAgentOption func(*RegistryAgentOptions)
@@ -73,13 +191,76 @@ func WithRegistryFlat(v bool) RegistryAgentOption {
 	}
 }
 
+func WithRegistryWatch(pollInterval time.Duration) RegistryAgentOption {
+	return func(o *RegistryAgentOptions) {
+		o.Watch = true
+		o.PollInterval = pollInterval
+	}
+}
+
+func WithRegistryLowMemory() RegistryAgentOption {
+	return func(o *RegistryAgentOptions) {
+		o.LowMemory = true
+	}
+}
+
+func WithRegistryPartialLoad() RegistryAgentOption {
+	return func(o *RegistryAgentOptions) {
+		o.PartialLoad = true
+	}
+}
+
+func WithRegistryCacheDir(dir string) RegistryAgentOption {
+	return func(o *RegistryAgentOptions) {
+		o.CacheDir = dir
+	}
+}
+
+// WithRegistryConfigAgent makes WhoReferences include the configs of agent
+func WithRegistryConfigAgent(agent ConfigAgent) RegistryAgentOption {
+	return func(o *RegistryAgentOptions) {
+		o.ConfigAgent = agent
+	}
+}
+
+// WithRegistryLayers layers the registries at paths over the registry, like
+// private registries over the public one, in increasing priority
+func WithRegistryLayers(paths ...string) RegistryAgentOption {
+	return func(o *RegistryAgentOptions) {
+		o.Layers = append(o.Layers, paths...)
+	}
+}
+
 // NewRegistryAgent returns a RegistryAgent interface that automatically reloads when
 // the registry is changed on disk.
 func NewRegistryAgent(registryPath string, opts ...RegistryAgentOption) (RegistryAgent, error) {
-	opt := &RegistryAgentOptions{}
+	opt := RegistryAgentOptions{}
 	for _, o := range opts {
-		o(opt)
+		o(&opt)
+	}
+	a, err := newRegistryAgent(registryPath, opt)
+	if err != nil {
+		return nil, err
+	}
+	for _, root := range watchedRoots(a.roots()) {
+		if opt.Watch {
+			err = watchChanges(root, a.loadRegistry, a.ReloadPaths, a.recordError)
+		} else {
+			err = startWatchers(root, a.loadRegistry, a.recordError)
+		}
+		if err != nil {
+			return nil, err
+		}
 	}
+	if opt.Watch {
+		pollReloads(a.loadRegistry, opt.PollInterval, a.recordError)
+	}
+	return a, nil
+}
+
+// newRegistryAgent returns a registryAgent that has loaded the registry in
+// registryPath but does not watch it for changes
+func newRegistryAgent(registryPath string, opt RegistryAgentOptions) (*registryAgent, error) {
 	if opt.ErrorMetric == nil {
 		opt.ErrorMetric = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "registry_agent_errors_total"}, []string{"error"})
 	}
@@ -92,16 +273,36 @@ func NewRegistryAgent(registryPath string, opts ...RegistryAgentOption) (Registr
 	}
 	a := &registryAgent{
 		registryPath: registryPath,
+		layers:       opt.Layers,
 		lock:         &sync.RWMutex{},
 		errorMetrics: opt.ErrorMetric,
 		flags:        flags,
+		lowMemory:    opt.LowMemory,
+		partial:      opt.PartialLoad,
+		interner:     load.NewInterner(),
+		configs:      opt.ConfigAgent,
+	}
+	a.nodes.transient = opt.LowMemory
+	diskCache := newDiskCache(opt.CacheDir, "registry", fmt.Sprintf("flags=%d", flags), a.roots()...)
+	var cached cachedRegistry
+	if diskCache.load(&cached) {
+		a.interner.Intern(&cached.Content)
+		if err := a.reload(func() (RegistryContent, map[string]string, error) {
+			return cached.Content, cached.Paths, nil
+		}); err != nil {
+			return nil, fmt.Errorf("failed to load cached registry: %w", err)
+		}
+		return a, nil
 	}
 	// Load config once so we fail early if that doesn't work and are ready as soon as we return
 	if err := a.loadRegistry(); err != nil {
 		return nil, fmt.Errorf("failed to load registry: %w", err)
 	}
-
-	return a, startWatchers(a.registryPath, a.loadRegistry, a.recordError)
+	// the cache does not hold the errors of a partial load
+	if len(a.LoadErrors()) == 0 {
+		diskCache.store(cachedRegistry{Content: a.GetRegistryContent(), Paths: a.paths})
+	}
+	return a, nil
 }
 
 func (a *registryAgent) recordError(label string) {
@@ -111,9 +312,19 @@ func (a *registryAgent) recordError(label string) {
 
 // ResolveConfig uses the registryAgent's resolver to resolve a provided ReleaseBuildConfiguration
 func (a *registryAgent) ResolveConfig(config api.ReleaseBuildConfiguration) (api.ReleaseBuildConfiguration, error) {
-	a.lock.RLock()
-	defer a.lock.RUnlock()
-	return registry.ResolveConfig(a.resolver, config)
+	return registry.ResolveConfig(copyingResolver{snapshot: a.Snapshot()}, config)
+}
+
+func (a *registryAgent) ResolveTest(name string, config api.MultiStageTestConfiguration) (api.MultiStageTestConfigurationLiteral, map[string]FieldSource, error) {
+	resolved, sources, err := a.Snapshot().ResolveTest(name, config)
+	if err != nil {
+		return api.MultiStageTestConfigurationLiteral{}, nil, err
+	}
+	return *resolved.DeepCopy(), sources, nil
+}
+
+func (a *registryAgent) ComponentMetadata(name string, kind registry.Type) (ComponentMetadata, error) {
+	return a.Snapshot().ComponentMetadata(name, kind)
 }
 
 func (a *registryAgent) GetGeneration() int {
@@ -126,34 +337,274 @@ func (a *registryAgent) GetRegistryComponents() (registry.ReferenceByName, regis
 	return a.references, a.chains, a.workflows, a.documentation, a.metadata
 }
 
+func (a *registryAgent) GetRegistryContent() RegistryContent {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return RegistryContent{
+		References:    a.references,
+		Chains:        a.chains,
+		Workflows:     a.workflows,
+		Observers:     a.observers,
+		Documentation: a.documentation,
+		Metadata:      a.metadata,
+	}
+}
+
+func (a *registryAgent) WhoReferences(name string, kind registry.Type) (References, error) {
+	components, err := a.Snapshot().WhoReferences(name, kind)
+	if err != nil {
+		return References{}, err
+	}
+	references := References{Components: components}
+	if a.configs != nil {
+		if references.Configs, err = a.configs.GetConfigsUsingComponent(name, kind); err != nil {
+			return References{}, fmt.Errorf("failed to get configs using %s %s: %w", kind, name, err)
+		}
+	}
+	return references, nil
+}
+
+func (a *registryAgent) SetOverlay(path string, content []byte) error {
+	if a.remote != "" {
+		return errRemoteAgent
+	}
+	return updateOverlay(a.lock, &a.overlay, a.rootOf(path), path, content, false, a.ReloadPaths)
+}
+
+func (a *registryAgent) RemoveOverlay(path string) error {
+	if a.remote != "" {
+		return errRemoteAgent
+	}
+	return updateOverlay(a.lock, &a.overlay, a.rootOf(path), path, nil, true, a.ReloadPaths)
+}
+
+func (a *registryAgent) Subscribe(callback func(RegistryChange)) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.subscribers = append(a.subscribers, callback)
+}
+
 func (a *registryAgent) loadRegistry() error {
 	logrus.Debug("Reloading registry")
+	return a.reload(a.fromFiles(func(files *load.RegistryFiles) error {
+		a.nodes.reset()
+		return files.Load(a.overlay)
+	}))
+}
+
+func (a *registryAgent) ReloadPaths(paths []string) error {
+	if a.remote != "" {
+		return errRemoteAgent
+	}
+	logrus.WithField("paths", paths).Debug("Reloading registry paths")
+	return a.reload(a.fromFiles(func(files *load.RegistryFiles) error {
+		var inRegistry []string
+		for _, path := range paths {
+			path, err := overlayPath(a.rootOf(path), path)
+			if err != nil {
+				logrus.WithError(err).Debug("Ignoring path outside of the registry")
+				continue
+			}
+			inRegistry = append(inRegistry, path)
+		}
+		a.nodes.invalidate(inRegistry)
+		return files.Reload(inRegistry, a.overlay)
+	}))
+}
+
+func (a *registryAgent) Node(path string) (*yaml.Node, error) {
+	if a.remote != "" {
+		return nil, errRemoteAgent
+	}
+	key, err := overlayPath(a.rootOf(path), path)
+	if err != nil {
+		return nil, err
+	}
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.nodes.get(key, a.overlay)
+}
+
+// cachedRegistry is the state of a registry agent that is stored on disk
+type cachedRegistry struct {
+	Content RegistryContent   `json:"content"`
+	Paths   map[string]string `json:"paths,omitempty"`
+}
+
+// roots returns the paths of the registry and its layers in increasing priority
+func (a *registryAgent) roots() []string {
+	return append([]string{a.registryPath}, a.layers...)
+}
+
+// watchedRoots returns the roots that need to be watched, which are the ones
+// that are not at or below another root, as watching those already covers them
+func watchedRoots(roots []string) []string {
+	var watched []string
+	for i, root := range roots {
+		covered := false
+		for j, other := range roots {
+			// of equal roots, only the first one is watched
+			if i != j && isUnder(other, root) && (j < i || !isUnder(root, other)) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			watched = append(watched, root)
+		}
+	}
+	return watched
+}
+
+// rootOf returns the path of the registry or layer that path is in, falling
+// back to the registry if it is in none of them
+func (a *registryAgent) rootOf(path string) string {
+	roots := a.roots()
+	for i := len(roots) - 1; i >= 0; i-- {
+		if _, err := overlayPath(roots[i], path); err == nil {
+			return roots[i]
+		}
+	}
+	return a.registryPath
+}
+
+// fromFiles returns a function for reload that updates the registry files with
+// update and returns their components along with the files that define them
+func (a *registryAgent) fromFiles(update func(*load.RegistryFiles) error) func() (RegistryContent, map[string]string, error) {
+	return func() (RegistryContent, map[string]string, error) {
+		fresh := a.files == nil
+		if fresh {
+			a.files = load.NewLayeredRegistryFiles(a.roots(), a.flags)
+			a.files.SetInterner(a.interner)
+			if !a.lowMemory {
+				a.files.SetCache(newParseCache())
+			}
+			if a.partial {
+				a.files.SetPartial()
+			}
+			// the registry was not loaded from its files yet, like when it was
+			// loaded from the disk cache, so they all need to be loaded
+			update = func(files *load.RegistryFiles) error {
+				return files.Load(a.overlay)
+			}
+		}
+		if err := update(a.files); err != nil {
+			if fresh {
+				a.files = nil
+			}
+			fileErrors, _ := load.FileErrors(err)
+			for range fileErrors {
+				a.recordError("failed to load registry file")
+			}
+			return RegistryContent{}, nil, err
+		}
+		for range a.files.FileErrors() {
+			a.recordError("failed to load registry file")
+		}
+		references, chains, workflows, documentation, metadata, observers := a.files.Components()
+		return RegistryContent{
+			References:    references,
+			Chains:        chains,
+			Workflows:     workflows,
+			Observers:     observers,
+			Documentation: documentation,
+			Metadata:      metadata,
+		}, a.files.ComponentPaths(), nil
+	}
+}
+
+// reload replaces the registry with the one returned by loadContent, which is
+// called while holding the lock and also returns the files that define the
+// components, if they are known
+func (a *registryAgent) reload(loadContent func() (RegistryContent, map[string]string, error)) error {
+	var change RegistryChange
+	var subscribers []func(RegistryChange)
+	var components int
 	duration, err := func() (time.Duration, error) {
 		a.lock.Lock()
 		defer a.lock.Unlock()
 		startTime := time.Now()
-		references, chains, workflows, documentation, metadata, observers, err := load.Registry(a.registryPath, a.flags)
+		content, paths, err := loadContent()
 		if err != nil {
 			a.recordError("failed to load ci-operator registry")
 			return time.Duration(0), fmt.Errorf("failed to load ci-operator registry (%w)", err)
 		}
+		references, chains, workflows, observers := content.References, content.Chains, content.Workflows, content.Observers
+		graph, err := registry.NewGraph(references, chains, workflows)
+		if err != nil {
+			a.recordError("failed to build registry graph")
+			return time.Duration(0), fmt.Errorf("failed to build registry graph: %w", err)
+		}
+		if len(a.subscribers) > 0 {
+			change = RegistryChange{
+				References: changedNames(sets.StringKeySet(a.references), sets.StringKeySet(references), func(name string) bool {
+					return reflect.DeepEqual(a.references[name], references[name])
+				}),
+				Chains: changedNames(sets.StringKeySet(a.chains), sets.StringKeySet(chains), func(name string) bool {
+					return reflect.DeepEqual(a.chains[name], chains[name])
+				}),
+				Workflows: changedNames(sets.StringKeySet(a.workflows), sets.StringKeySet(workflows), func(name string) bool {
+					return reflect.DeepEqual(a.workflows[name], workflows[name])
+				}),
+				Observers: changedNames(sets.StringKeySet(a.observers), sets.StringKeySet(observers), func(name string) bool {
+					return reflect.DeepEqual(a.observers[name], observers[name])
+				}),
+			}
+			subscribers = append(subscribers, a.subscribers...)
+		}
 		a.references = references
 		a.chains = chains
 		a.workflows = workflows
-		a.documentation = documentation
-		a.metadata = metadata
-		a.resolver = registry.NewResolver(references, chains, workflows, observers)
+		a.observers = observers
+		a.documentation = content.Documentation
+		a.metadata = content.Metadata
+		a.graph = graph
+		a.paths = paths
+		a.resolver = registry.NewComponentResolver(references, chains, workflows, observers)
+		a.memo = newResolutionMemo()
+		components = len(references) + len(chains) + len(workflows) + len(observers)
 		a.generation++
+		change.Generation = a.generation
 		return time.Since(startTime), nil
 	}()
 	if err != nil {
 		return err
 	}
-	configReloadTimeMetric.Observe(duration.Seconds())
-	logrus.WithField("duration", duration).Info("Registry reloaded")
+	registryReloadTimeMetric.Observe(duration.Seconds())
+	recordLoad("registry", a.registryPath, components)
+	logrus.WithFields(logrus.Fields{"duration": duration, "components": components}).Info("Registry reloaded")
+	for _, subscriber := range subscribers {
+		subscriber(change)
+	}
 	return nil
 }
 
+// changedNames compares two sets of names, using unchanged to determine whether
+// an item that exists in both sets was changed
+func changedNames(oldNames, newNames sets.String, unchanged func(name string) bool) ChangedNames {
+	var names ChangedNames
+	for _, name := range newNames.List() {
+		if !oldNames.Has(name) {
+			names.Added = append(names.Added, name)
+		} else if !unchanged(name) {
+			names.Changed = append(names.Changed, name)
+		}
+	}
+	if removed := oldNames.Difference(newNames); removed.Len() > 0 {
+		names.Removed = removed.List()
+	}
+	return names
+}
+
+func (a *registryAgent) LoadErrors() []*load.FileError {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	if a.files == nil {
+		return nil
+	}
+	return a.files.FileErrors()
+}
+
 func (a *registryAgent) Resolve(name string, config api.MultiStageTestConfiguration) (api.MultiStageTestConfigurationLiteral, error) {
-	return a.resolver.Resolve(name, config)
+	return copyingResolver{snapshot: a.Snapshot()}.Resolve(name, config)
 }
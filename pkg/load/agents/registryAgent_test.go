@@ -0,0 +1,411 @@
+package agents
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/openshift/ci-tools/pkg/api"
+	"github.com/openshift/ci-tools/pkg/load"
+	"github.com/openshift/ci-tools/pkg/registry"
+)
+
+func TestRegistryAgent_WhoReferences(t *testing.T) {
+	chain, workflow := "ipi-install", "ipi"
+	master := api.ReleaseBuildConfiguration{
+		Metadata: api.Metadata{Org: "org", Repo: "repo", Branch: "master"},
+		Tests: []api.TestStepConfiguration{
+			{As: "e2e", MultiStageTestConfiguration: &api.MultiStageTestConfiguration{Workflow: &workflow}},
+			{As: "install", MultiStageTestConfiguration: &api.MultiStageTestConfiguration{Pre: []api.TestStep{{Chain: &chain}}}},
+		},
+	}
+	agent := &registryAgent{
+		lock:         &sync.RWMutex{},
+		registryPath: "../../../test/multistage-registry/registry",
+		flags:        load.RegistryMetadata | load.RegistryDocumentation,
+		configs:      NewFakeConfigAgent(load.ByOrgRepo{"org": {"repo": {master}}}),
+	}
+	if err := agent.loadRegistry(); err != nil {
+		t.Fatalf("failed to load registry: %v", err)
+	}
+
+	testCases := []struct {
+		name          string
+		component     string
+		kind          registry.Type
+		expected      []string
+		expectedError string
+		// expectedConfigs holds the branches of the configs
+		expectedConfigs []string
+	}{
+		{
+			name:      "reference used by a chain",
+			component: "ipi-install-install",
+			kind:      registry.Reference,
+			expected:  []string{"chain/ipi-install"},
+		},
+		{
+			name:      "chain used by chains and workflows",
+			component: "ipi-install",
+			kind:      registry.Chain,
+			expected: []string{
+				"workflow/ipi",
+				"workflow/ipi-changed",
+				"chain/ipi-install-empty-parameter",
+				"chain/ipi-install-with-parameter",
+			},
+			expectedConfigs: []string{"master"},
+		},
+		{
+			name:            "workflows are only referenced by configs",
+			component:       "ipi",
+			kind:            registry.Workflow,
+			expectedConfigs: []string{"master"},
+		},
+		{
+			name:          "unknown component",
+			component:     "ipi-install-missing",
+			kind:          registry.Reference,
+			expectedError: "no reference named ipi-install-missing",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			references, err := agent.WhoReferences(tc.component, tc.kind)
+			errMsg := ""
+			if err != nil {
+				errMsg = err.Error()
+			}
+			if tc.expectedError != errMsg {
+				t.Fatalf("got error %q expected error %q", errMsg, tc.expectedError)
+			}
+			var actual []string
+			for _, node := range references.Components {
+				actual = append(actual, node.Type().String()+"/"+node.Name())
+			}
+			if diff := cmp.Diff(tc.expected, actual); diff != "" {
+				t.Errorf("expected result does not match actual result, diff: %v", diff)
+			}
+			var actualConfigs []string
+			for _, config := range references.Configs {
+				actualConfigs = append(actualConfigs, config.Metadata.Branch)
+			}
+			if diff := cmp.Diff(tc.expectedConfigs, actualConfigs); diff != "" {
+				t.Errorf("expected configs do not match actual configs, diff: %v", diff)
+			}
+		})
+	}
+}
+
+func TestRegistryAgent_Subscribe(t *testing.T) {
+	root := "../../../test/multistage-registry/registry"
+	agent := &registryAgent{
+		lock:         &sync.RWMutex{},
+		registryPath: root,
+		flags:        load.RegistryMetadata | load.RegistryDocumentation,
+	}
+	if err := agent.loadRegistry(); err != nil {
+		t.Fatalf("failed to load registry: %v", err)
+	}
+	var changes []RegistryChange
+	agent.Subscribe(func(change RegistryChange) {
+		changes = append(changes, change)
+	})
+
+	extraRef := []byte(`ref:
+  as: ipi-install-extra
+  from: installer
+  commands: ipi-install-extra-commands.sh
+  resources:
+    requests:
+      cpu: 1000m
+      memory: 2Gi
+  documentation: |-
+    An extra step
+`)
+	agent.overlay = load.Overlay{
+		filepath.Join(root, "ipi/install/install/ipi-install-install-commands.sh"): []byte("overlay install\n"),
+		filepath.Join(root, "ipi/install/extra/ipi-install-extra-commands.sh"):     []byte("extra\n"),
+		filepath.Join(root, "ipi/install/extra/ipi-install-extra-ref.yaml"):        extraRef,
+	}
+	if err := agent.loadRegistry(); err != nil {
+		t.Fatalf("failed to reload registry: %v", err)
+	}
+	if err := agent.RemoveOverlay(filepath.Join(root, "ipi/install/extra/ipi-install-extra-ref.yaml")); err != nil {
+		t.Fatalf("failed to remove overlay: %v", err)
+	}
+
+	expected := []RegistryChange{
+		{
+			Generation: 2,
+			References: ChangedNames{Added: []string{"ipi-install-extra"}, Changed: []string{"ipi-install-install"}},
+		},
+		{
+			Generation: 3,
+			References: ChangedNames{Removed: []string{"ipi-install-extra"}},
+		},
+	}
+	if diff := cmp.Diff(expected, changes); diff != "" {
+		t.Errorf("expected changes do not match actual changes, diff: %v", diff)
+	}
+}
+
+func TestRegistryAgent_ResolveTest(t *testing.T) {
+	registryPath := "../../../test/multistage-registry/registry"
+	agent := &registryAgent{
+		lock:         &sync.RWMutex{},
+		registryPath: registryPath,
+		flags:        load.RegistryMetadata | load.RegistryDocumentation,
+	}
+	if err := agent.loadRegistry(); err != nil {
+		t.Fatalf("failed to load registry: %v", err)
+	}
+	workflow, chain := "ipi", "ipi-install-with-parameter"
+	config := api.MultiStageTestConfiguration{
+		Workflow:       &workflow,
+		ClusterProfile: api.ClusterProfileAWS,
+		Pre:            []api.TestStep{{Chain: &chain}},
+		Test:           []api.TestStep{{LiteralTestStep: &api.LiteralTestStep{As: "e2e", From: "src", Commands: "make e2e"}}},
+	}
+	resolved, sources, err := agent.ResolveTest("e2e", config)
+	if err != nil {
+		t.Fatalf("failed to resolve test: %v", err)
+	}
+	var steps []string
+	for _, step := range append(resolved.Pre, append(resolved.Test, resolved.Post...)...) {
+		steps = append(steps, step.As)
+	}
+	if diff := cmp.Diff([]string{"ipi-install-rbac", "ipi-install-install", "e2e", "ipi-deprovision-must-gather", "ipi-deprovision-deprovision"}, steps); diff != "" {
+		t.Errorf("unexpected resolved steps, diff: %v", diff)
+	}
+	expected := map[string]FieldSource{
+		"cluster_profile":           {Component: "test/e2e"},
+		"pre[0]":                    {Component: "reference/ipi-install-rbac", Path: filepath.Join(registryPath, "ipi/install/rbac/ipi-install-rbac-ref.yaml")},
+		"pre[1]":                    {Component: "reference/ipi-install-install", Path: filepath.Join(registryPath, "ipi/install/install/ipi-install-install-ref.yaml")},
+		"pre[1].env.TEST_PARAMETER": {Component: "chain/ipi-install-with-parameter", Path: filepath.Join(registryPath, "ipi/install/with-parameter/ipi-install-with-parameter-chain.yaml")},
+		"test[0]":                   {Component: "test/e2e"},
+		"post[0]":                   {Component: "reference/ipi-deprovision-must-gather", Path: filepath.Join(registryPath, "ipi/deprovision/must-gather/ipi-deprovision-must-gather-ref.yaml")},
+		"post[1]":                   {Component: "reference/ipi-deprovision-deprovision", Path: filepath.Join(registryPath, "ipi/deprovision/deprovision/ipi-deprovision-deprovision-ref.yaml")},
+		"observers[0]":              {Component: "observer/resourcewatcher", Path: filepath.Join(registryPath, "resourcewatcher/resourcewatcher-observer.yaml")},
+	}
+	if diff := cmp.Diff(expected, sources); diff != "" {
+		t.Errorf("unexpected sources, diff: %v", diff)
+	}
+
+	missing := "missing"
+	if _, _, err := agent.ResolveTest("e2e", api.MultiStageTestConfiguration{Workflow: &missing}); err == nil {
+		t.Error("expected resolving a test with a missing workflow to fail")
+	}
+}
+
+func TestRegistryAgent_Snapshot(t *testing.T) {
+	registryPath := "../../../test/multistage-registry/registry"
+	agent := &registryAgent{
+		lock:         &sync.RWMutex{},
+		registryPath: registryPath,
+		flags:        load.RegistryMetadata | load.RegistryDocumentation,
+	}
+	if err := agent.loadRegistry(); err != nil {
+		t.Fatalf("failed to load registry: %v", err)
+	}
+	snapshot := agent.Snapshot()
+	if err := agent.SetOverlay(filepath.Join(registryPath, "ipi/install/install/ipi-install-install-commands.sh"), []byte("changed\n")); err != nil {
+		t.Fatalf("failed to set overlay: %v", err)
+	}
+
+	commands := func(snapshot *RegistrySnapshot) string {
+		reference, ok := snapshot.Reference("ipi-install-install")
+		if !ok {
+			t.Fatal("reference ipi-install-install not in snapshot")
+		}
+		return reference.Commands
+	}
+	if actual := commands(snapshot); actual != "openshift-cluster install\n" {
+		t.Errorf("expected snapshot to retain the registry it was taken of, got commands %q", actual)
+	}
+	current := agent.Snapshot()
+	if actual := commands(current); actual != "changed\n" {
+		t.Errorf("expected new snapshot to have the reloaded registry, got commands %q", actual)
+	}
+	if current.Generation() != snapshot.Generation()+1 {
+		t.Errorf("expected generation of new snapshot to be %d, got %d", snapshot.Generation()+1, current.Generation())
+	}
+	chainCommands := func(snapshot *RegistrySnapshot) string {
+		steps, err := snapshot.ResolveChain("ipi-install")
+		if err != nil {
+			t.Fatalf("failed to resolve chain: %v", err)
+		}
+		again, err := snapshot.ResolveChain("ipi-install")
+		if err != nil {
+			t.Fatalf("failed to resolve chain again: %v", err)
+		}
+		if &steps[0] != &again[0] {
+			t.Error("expected the chain to be resolved once per generation")
+		}
+		return steps[len(steps)-1].Commands
+	}
+	if actual := chainCommands(snapshot); actual != "openshift-cluster install\n" {
+		t.Errorf("expected chain resolved in snapshot to use the registry it was taken of, got commands %q", actual)
+	}
+	if actual := chainCommands(current); actual != "changed\n" {
+		t.Errorf("expected chain resolved in new snapshot to use the reloaded registry, got commands %q", actual)
+	}
+	test := func() api.MultiStageTestConfiguration {
+		chain := "ipi-install"
+		return api.MultiStageTestConfiguration{Pre: []api.TestStep{{Chain: &chain}}}
+	}
+	first, err := current.Resolve("e2e", test())
+	if err != nil {
+		t.Fatalf("failed to resolve test: %v", err)
+	}
+	second, err := current.Resolve("e2e", test())
+	if err != nil {
+		t.Fatalf("failed to resolve test again: %v", err)
+	}
+	if &first.Pre[0] != &second.Pre[0] {
+		t.Error("expected the test to be resolved once per generation")
+	}
+	copied, err := agent.Resolve("e2e", test())
+	if err != nil {
+		t.Fatalf("failed to resolve test with agent: %v", err)
+	}
+	copied.Pre[0].Commands = "modified"
+	if first.Pre[0].Commands == "modified" {
+		t.Error("expected the agent to return copies of the tests it resolved")
+	}
+	names, err := snapshot.Names(registry.Chain)
+	if err != nil {
+		t.Fatalf("failed to get chain names: %v", err)
+	}
+	if diff := cmp.Diff([]string{"ipi-deprovision", "ipi-install", "ipi-install-empty-parameter", "ipi-install-with-parameter"}, names); diff != "" {
+		t.Errorf("unexpected chain names, diff: %v", diff)
+	}
+	if expected, actual := filepath.Join(registryPath, "ipi/install/ipi-install-chain.yaml"), snapshot.Path("chain/ipi-install"); actual != expected {
+		t.Errorf("expected path %s for chain, got %s", expected, actual)
+	}
+}
+
+func TestRegistryAgent_Layers(t *testing.T) {
+	registryPath := "../../../test/multistage-registry/registry"
+	private := t.TempDir()
+	for path, content := range map[string]string{
+		"ipi-install-install-ref.yaml": `ref:
+  as: ipi-install-install
+  from: installer
+  commands: ipi-install-install-commands.sh
+  resources:
+    requests:
+      cpu: 1000m
+      memory: 2Gi
+  env:
+  - name: TEST_PARAMETER
+    default: private default
+  documentation: |-
+    Installs a cluster the private way.
+`,
+		"ipi-install-install-commands.sh": "private-install\n",
+		"private-install-chain.yaml": `chain:
+  as: private-install
+  steps:
+  - ref: ipi-install-rbac
+  - ref: ipi-install-install
+`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(private, path), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write registry file: %v", err)
+		}
+	}
+	created, err := NewRegistryAgent(registryPath, WithRegistryLayers(private))
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	agent := created.(*registryAgent)
+	if diff := cmp.Diff([]string{private}, agent.layers); diff != "" {
+		t.Errorf("expected the options to be applied once, diff: %v", diff)
+	}
+	chain := "private-install"
+	resolved, err := agent.Resolve("e2e", api.MultiStageTestConfiguration{
+		ClusterProfile: api.ClusterProfileAWS,
+		Pre:            []api.TestStep{{Chain: &chain}},
+	})
+	if err != nil {
+		t.Fatalf("failed to resolve test with chain from layer: %v", err)
+	}
+	var commands []string
+	for _, step := range resolved.Pre {
+		commands = append(commands, step.Commands)
+	}
+	if diff := cmp.Diff([]string{"setup-rbac\n", "private-install\n"}, commands); diff != "" {
+		t.Errorf("expected the reference of the layer to replace the one of the registry, diff: %v", diff)
+	}
+	if expected, actual := filepath.Join(private, "ipi-install-install-ref.yaml"), agent.Snapshot().Path("reference/ipi-install-install"); actual != expected {
+		t.Errorf("expected reference to be defined in %s, got %s", expected, actual)
+	}
+
+	if err := agent.SetOverlay(filepath.Join(private, "ipi-install-install-commands.sh"), []byte("changed\n")); err != nil {
+		t.Fatalf("failed to set overlay in layer: %v", err)
+	}
+	if reference, _ := agent.Snapshot().Reference("ipi-install-install"); reference.Commands != "changed\n" {
+		t.Errorf("expected overlay in layer to be loaded, got commands %q", reference.Commands)
+	}
+}
+
+func TestRegistryAgent_PartialLoad(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write registry file: %v", err)
+		}
+	}
+	reference := func(name string) string {
+		return `ref:
+  as: ` + name + `
+  from: installer
+  commands: ` + name + `-commands.sh
+  resources:
+    requests:
+      cpu: 1000m
+  documentation: |-
+    Does things.
+`
+	}
+	write("valid-ref.yaml", reference("valid"))
+	write("valid-commands.sh", "valid\n")
+	write("broken-ref.yaml", "ref:\n  as: broken\n  from: [\n")
+	write("broken-commands.sh", "broken\n")
+
+	if _, err := newRegistryAgent(dir, RegistryAgentOptions{}); err == nil {
+		t.Error("expected loading a broken registry file to fail without partial loading")
+	}
+	agent, err := newRegistryAgent(dir, RegistryAgentOptions{PartialLoad: true})
+	if err != nil {
+		t.Fatalf("failed to load registry partially: %v", err)
+	}
+	if _, ok := agent.Snapshot().Reference("valid"); !ok {
+		t.Error("expected the valid reference to be loaded")
+	}
+	erroredFiles := func() []string {
+		var files []string
+		for _, fileErr := range agent.LoadErrors() {
+			files = append(files, filepath.Base(fileErr.Path))
+		}
+		return files
+	}
+	if diff := cmp.Diff([]string{"broken-ref.yaml"}, erroredFiles()); diff != "" {
+		t.Errorf("unexpected load errors, diff: %v", diff)
+	}
+
+	write("broken-ref.yaml", reference("broken"))
+	if err := agent.ReloadPaths([]string{filepath.Join(dir, "broken-ref.yaml")}); err != nil {
+		t.Fatalf("failed to reload fixed registry file: %v", err)
+	}
+	if diff := cmp.Diff([]string(nil), erroredFiles()); diff != "" {
+		t.Errorf("expected no load errors after fixing the registry file, diff: %v", diff)
+	}
+	if _, ok := agent.Snapshot().Reference("broken"); !ok {
+		t.Error("expected the fixed reference to be loaded")
+	}
+}
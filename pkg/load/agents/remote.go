@@ -0,0 +1,508 @@
+package agents
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+
+	"k8s.io/test-infra/prow/interrupts"
+	"k8s.io/test-infra/prow/metrics"
+
+	"github.com/openshift/ci-tools/pkg/api"
+	"github.com/openshift/ci-tools/pkg/load"
+	"github.com/openshift/ci-tools/pkg/registry"
+)
+
+// RegistryContent holds all components of a step registry. The configresolver
+// serves it to registry agents that load from a remote configresolver.
+type RegistryContent struct {
+	References    registry.ReferenceByName `json:"references,omitempty"`
+	Chains        registry.ChainByName     `json:"chains,omitempty"`
+	Workflows     registry.WorkflowByName  `json:"workflows,omitempty"`
+	Observers     registry.ObserverByName  `json:"observers,omitempty"`
+	Documentation map[string]string        `json:"documentation,omitempty"`
+	Metadata      api.RegistryMetadata     `json:"metadata,omitempty"`
+}
+
+// errRemoteAgent is returned for operations on files, which agents that load
+// from a remote configresolver do not have
+var errRemoteAgent = errors.New("agents that load from a remote configresolver do not have files")
+
+// remotePollInterval is how often agents check whether the content of the
+// remote configresolver changed
+const remotePollInterval = time.Minute
+
+// remoteClient is the client that agents use for requests to the remote
+// configresolver
+var remoteClient = &http.Client{Timeout: time.Minute}
+
+// remoteConfigAgent is a ConfigAgent that loads configs from a remote
+// configresolver when they are used. GetMatchingConfig loads the configs of one
+// repo; the other methods need all configs, which are loaded once and from
+// then on reloaded whenever the configs of the configresolver change.
+type remoteConfigAgent struct {
+	address      string
+	errorMetrics *prometheus.CounterVec
+
+	lock sync.Mutex
+	// generation is the generation of the configs of the configresolver
+	generation int
+	// repos holds the agents for the configs of the repos that were loaded at
+	// generation, by org and repo
+	repos map[string]*configAgent
+	// all is the agent for all configs once they were needed, which holds
+	// them as of allGeneration
+	all           *configAgent
+	allGeneration int
+}
+
+// NewRemoteConfigAgent returns a ConfigAgent that loads the configs from the
+// configresolver at address instead of from disk. The agent is lazy: it only
+// downloads the configs of a repo when a config of that repo is requested, and
+// all configs when a method needs them. Once downloaded, all configs are kept
+// up to date with the configresolver. Options that only apply to configs on
+// disk are rejected.
+func NewRemoteConfigAgent(address string, opts ...ConfigAgentOption) (ConfigAgent, error) {
+	opt := ConfigAgentOptions{}
+	for _, o := range opts {
+		o(&opt)
+	}
+	a, err := newRemoteConfigAgent(address, opt)
+	if err != nil {
+		return nil, err
+	}
+	interrupts.TickLiteral(a.sync, remotePollInterval)
+	return a, nil
+}
+
+// newRemoteConfigAgent returns a remoteConfigAgent that does not poll the
+// configresolver for changes
+func newRemoteConfigAgent(address string, opt ConfigAgentOptions) (*remoteConfigAgent, error) {
+	if opt.PartialLoad || opt.LazyValidation || opt.CacheDir != "" || opt.Watch {
+		return nil, errors.New("partial loads, lazy validation, cache directories and watches are not supported for agents that load from a remote configresolver")
+	}
+	if opt.ErrorMetric == nil {
+		opt.ErrorMetric = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "config_agent_errors_total"}, []string{"error"})
+	}
+	address = strings.TrimSuffix(address, "/")
+	generation, err := remoteGeneration(address + "/configGeneration")
+	if err != nil {
+		return nil, err
+	}
+	return &remoteConfigAgent{address: address, errorMetrics: opt.ErrorMetric, generation: generation, repos: map[string]*configAgent{}}, nil
+}
+
+// sync drops the configs of repos when the configs of the configresolver
+// changed and reloads all configs if they were loaded before
+func (a *remoteConfigAgent) sync() {
+	current, err := remoteGeneration(a.address + "/configGeneration")
+	if err != nil {
+		a.recordError("failed to get generation from configresolver")
+		logrus.WithError(err).Error("Failed to get generation from configresolver")
+		return
+	}
+	a.lock.Lock()
+	if current != a.generation {
+		a.generation = current
+		a.repos = map[string]*configAgent{}
+	}
+	all := a.all
+	if all == nil || a.allGeneration == current {
+		a.lock.Unlock()
+		return
+	}
+	a.lock.Unlock()
+	if err := all.reloadConfig(); err != nil {
+		logrus.WithError(err).Error("Failed to reload from configresolver")
+		return
+	}
+	a.lock.Lock()
+	a.allGeneration = current
+	a.lock.Unlock()
+}
+
+// getAll returns the agent for all configs, loading them if they were not
+// loaded yet
+func (a *remoteConfigAgent) getAll() (*configAgent, error) {
+	a.lock.Lock()
+	all, generation := a.all, a.generation
+	a.lock.Unlock()
+	if all != nil {
+		return all, nil
+	}
+	all = &configAgent{remote: a.address, lock: &sync.RWMutex{}, errorMetrics: a.errorMetrics}
+	all.reloadConfig = all.loadRemote
+	all.reloadPaths = func(_ []string) error {
+		return errRemoteAgent
+	}
+	if err := all.reloadConfig(); err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.all != nil {
+		// loaded concurrently
+		return a.all, nil
+	}
+	a.all, a.allGeneration = all, generation
+	return all, nil
+}
+
+// getRepo returns an agent for the configs of a repo, loading them if they
+// were not loaded at the current generation
+func (a *remoteConfigAgent) getRepo(org, repo string) (*configAgent, error) {
+	key := org + "/" + repo
+	a.lock.Lock()
+	if a.all != nil {
+		defer a.lock.Unlock()
+		return a.all, nil
+	}
+	agent, generation := a.repos[key], a.generation
+	a.lock.Unlock()
+	if agent != nil {
+		return agent, nil
+	}
+	var configs load.ByOrgRepo
+	query := url.Values{"org": []string{org}, "repo": []string{repo}}
+	if err := getJSON(a.address+"/configs?"+query.Encode(), &configs); err != nil {
+		a.recordError("failed to load configs from configresolver")
+		return nil, err
+	}
+	agent = &configAgent{remote: a.address, lock: &sync.RWMutex{}, configs: configs, errorMetrics: a.errorMetrics}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.generation == generation {
+		a.repos[key] = agent
+	}
+	return agent, nil
+}
+
+func (a *remoteConfigAgent) recordError(label string) {
+	a.errorMetrics.With(prometheus.Labels{"error": label}).Inc()
+}
+
+func (a *remoteConfigAgent) GetMatchingConfig(metadata api.Metadata) (api.ReleaseBuildConfiguration, error) {
+	agent, err := a.getRepo(metadata.Org, metadata.Repo)
+	if err != nil {
+		return api.ReleaseBuildConfiguration{}, err
+	}
+	return agent.GetMatchingConfig(metadata)
+}
+
+func (a *remoteConfigAgent) GetAll() load.ByOrgRepo {
+	all, err := a.getAll()
+	if err != nil {
+		logrus.WithError(err).Error("Failed to load configs from configresolver")
+		return nil
+	}
+	return all.GetAll()
+}
+
+func (a *remoteConfigAgent) Search(query api.Metadata) []api.Metadata {
+	all, err := a.getAll()
+	if err != nil {
+		logrus.WithError(err).Error("Failed to load configs from configresolver")
+		return nil
+	}
+	return all.Search(query)
+}
+
+// GetGeneration returns the generation of the configs of the configresolver
+func (a *remoteConfigAgent) GetGeneration() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.generation
+}
+
+func (a *remoteConfigAgent) AddIndex(indexName string, indexFunc IndexFn) error {
+	all, err := a.getAll()
+	if err != nil {
+		return err
+	}
+	return all.AddIndex(indexName, indexFunc)
+}
+
+func (a *remoteConfigAgent) GetFromIndex(indexName string, indexKey string) ([]*api.ReleaseBuildConfiguration, error) {
+	all, err := a.getAll()
+	if err != nil {
+		return nil, err
+	}
+	return all.GetFromIndex(indexName, indexKey)
+}
+
+func (a *remoteConfigAgent) SubscribeToIndexChanges(indexName string) (<-chan IndexDelta, error) {
+	all, err := a.getAll()
+	if err != nil {
+		return nil, err
+	}
+	return all.SubscribeToIndexChanges(indexName)
+}
+
+func (a *remoteConfigAgent) SetOverlay(string, []byte) error {
+	return errRemoteAgent
+}
+
+func (a *remoteConfigAgent) RemoveOverlay(string) error {
+	return errRemoteAgent
+}
+
+// Subscribe loads all configs, as the changes are determined from them. The
+// generation of the changes is the one of the configresolver.
+func (a *remoteConfigAgent) Subscribe(callback func(ConfigChange)) {
+	all, err := a.getAll()
+	if err != nil {
+		logrus.WithError(err).Error("Failed to load configs from configresolver")
+		return
+	}
+	all.Subscribe(func(change ConfigChange) {
+		change.Generation = a.GetGeneration()
+		callback(change)
+	})
+}
+
+func (a *remoteConfigAgent) ReloadPaths([]string) error {
+	return errRemoteAgent
+}
+
+func (a *remoteConfigAgent) Node(string) (*yaml.Node, error) {
+	return nil, errRemoteAgent
+}
+
+func (a *remoteConfigAgent) LoadErrors() []*load.FileError {
+	return nil
+}
+
+func (a *remoteConfigAgent) GetConfigsUsingComponent(name string, kind registry.Type) ([]*api.ReleaseBuildConfiguration, error) {
+	all, err := a.getAll()
+	if err != nil {
+		return nil, err
+	}
+	return all.GetConfigsUsingComponent(name, kind)
+}
+
+// loadRemote replaces the configs with the ones served by the remote configresolver
+func (a *configAgent) loadRemote() error {
+	logrus.WithField("address", a.remote).Debug("Reloading configs from configresolver")
+	var configs load.ByOrgRepo
+	if err := getJSON(a.remote+"/configs", &configs); err != nil {
+		a.recordError("failed to load configs from configresolver")
+		return err
+	}
+	return a.reload(func() (map[string]api.ReleaseBuildConfiguration, error) {
+		files := map[string]api.ReleaseBuildConfiguration{}
+		for _, orgConfigs := range configs {
+			for _, repoConfigs := range orgConfigs {
+				for _, config := range repoConfigs {
+					files[config.Metadata.RelativePath()] = config
+				}
+			}
+		}
+		return files, nil
+	})
+}
+
+// NewRemoteRegistryAgent returns a RegistryAgent that loads the registry from
+// the configresolver at address instead of from disk, and reloads it when the
+// registry of the configresolver changes. The agent is not lazy: it downloads
+// the whole registry when it is created and again whenever it changes. Options
+// that only apply to a registry on disk are rejected.
+func NewRemoteRegistryAgent(address string, opts ...RegistryAgentOption) (RegistryAgent, error) {
+	opt := &RegistryAgentOptions{}
+	for _, o := range opts {
+		o(opt)
+	}
+	if len(opt.Layers) > 0 || opt.PartialLoad || opt.CacheDir != "" || opt.Watch {
+		return nil, errors.New("layers, partial loads, cache directories and watches are not supported for agents that load from a remote configresolver")
+	}
+	if opt.ErrorMetric == nil {
+		opt.ErrorMetric = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "registry_agent_errors_total"}, []string{"error"})
+	}
+	address = strings.TrimSuffix(address, "/")
+	a := &registryAgent{remote: address, lock: &sync.RWMutex{}, errorMetrics: opt.ErrorMetric, configs: opt.ConfigAgent}
+	generation, err := remoteGeneration(address + "/registryGeneration")
+	if err != nil {
+		return nil, err
+	}
+	if err := a.loadRemote(); err != nil {
+		return nil, fmt.Errorf("failed to load registry: %w", err)
+	}
+	watchRemoteGeneration(address+"/registryGeneration", generation, a.loadRemote, a.recordError)
+	return a, nil
+}
+
+// loadRemote replaces the registry with the one served by the remote configresolver
+func (a *registryAgent) loadRemote() error {
+	logrus.WithField("address", a.remote).Debug("Reloading registry from configresolver")
+	var content RegistryContent
+	if err := getJSON(a.remote+"/registry", &content); err != nil {
+		a.recordError("failed to load registry from configresolver")
+		return err
+	}
+	return a.reload(func() (RegistryContent, map[string]string, error) {
+		return content, nil, nil
+	})
+}
+
+// watchRemoteGeneration periodically checks the generation served at url and
+// calls reload when it differs from the last one that was loaded
+func watchRemoteGeneration(url string, generation int, reload func() error, recordError func(string)) {
+	interrupts.TickLiteral(func() {
+		current, err := remoteGeneration(url)
+		if err != nil {
+			recordError("failed to get generation from configresolver")
+			logrus.WithError(err).Error("Failed to get generation from configresolver")
+			return
+		}
+		if current == generation {
+			return
+		}
+		if err := reload(); err != nil {
+			logrus.WithError(err).Error("Failed to reload from configresolver")
+			return
+		}
+		generation = current
+	}, remotePollInterval)
+}
+
+func remoteGeneration(url string) (int, error) {
+	raw, err := get(url)
+	if err != nil {
+		return 0, err
+	}
+	generation, err := strconv.Atoi(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse generation from %s: %w", url, err)
+	}
+	return generation, nil
+}
+
+func getJSON(url string, into interface{}) error {
+	raw, err := get(url)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, into); err != nil {
+		return fmt.Errorf("failed to unmarshal response from %s: %w", url, err)
+	}
+	return nil
+}
+
+func get(url string) ([]byte, error) {
+	resp, err := remoteClient.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request to %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body from %s: %w", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got unexpected http %d status code from %s: %s", resp.StatusCode, url, string(data))
+	}
+	return data, nil
+}
+
+// ServeConfigGeneration returns a handler that serves the generation of the
+// configs of agent, which remote config agents poll for changes
+func ServeConfigGeneration(agent ConfigAgent) http.HandlerFunc {
+	return serveGeneration(agent.GetGeneration)
+}
+
+// ServeRegistryGeneration returns a handler that serves the generation of the
+// registry of agent, which remote registry agents poll for changes
+func ServeRegistryGeneration(agent RegistryAgent) http.HandlerFunc {
+	return serveGeneration(agent.GetGeneration)
+}
+
+func serveGeneration(generation func() int) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "%d", generation())
+	}
+}
+
+// ServeConfigs returns a handler that serves the configs of agent to remote
+// config agents. The org and repo query parameters select the configs of one
+// repo. The response with all configs is only serialized once per generation.
+func ServeConfigs(agent ConfigAgent, m *metrics.Metrics) http.HandlerFunc {
+	all := &generationBody{}
+	return func(w http.ResponseWriter, r *http.Request) {
+		org, repo := r.URL.Query().Get("org"), r.URL.Query().Get("repo")
+		if org == "" && repo == "" {
+			writeBody(w, all.get(agent.GetGeneration(), func() interface{} {
+				return agent.GetAll()
+			}), m)
+			return
+		}
+		configs := load.ByOrgRepo{}
+		if repoConfigs, ok := agent.GetAll()[org][repo]; ok {
+			configs[org] = map[string][]api.ReleaseBuildConfiguration{repo: repoConfigs}
+		}
+		raw, err := json.Marshal(configs)
+		writeBody(w, body{raw: raw, err: err}, m)
+	}
+}
+
+// ServeRegistry returns a handler that serves the registry of agent to remote
+// registry agents. The response is only serialized once per generation.
+func ServeRegistry(agent RegistryAgent, m *metrics.Metrics) http.HandlerFunc {
+	content := &generationBody{}
+	return func(w http.ResponseWriter, _ *http.Request) {
+		writeBody(w, content.get(agent.GetGeneration(), func() interface{} {
+			return agent.GetRegistryContent()
+		}), m)
+	}
+}
+
+// body is a serialized response or the error serializing it
+type body struct {
+	raw []byte
+	err error
+}
+
+// generationBody holds a response serialized at one generation of an agent
+type generationBody struct {
+	lock       sync.Mutex
+	generation int
+	body       *body
+}
+
+// get returns the response serialized at generation or serializes the data
+// returned by content. The generation must be read before the content, so that
+// the content is at least as recent as the generation it is stored for.
+func (g *generationBody) get(generation int, content func() interface{}) body {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.body == nil || g.generation != generation {
+		raw, err := json.Marshal(content())
+		g.body, g.generation = &body{raw: raw, err: err}, generation
+	}
+	return *g.body
+}
+
+func writeBody(w http.ResponseWriter, b body, m *metrics.Metrics) {
+	if b.err != nil {
+		metrics.RecordError("failed to marshal response", m.ErrorRate)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to marshal response to JSON: %v", b.err)
+		logrus.WithError(b.err).Error("failed to marshal response to JSON")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(b.raw); err != nil {
+		logrus.WithError(err).Error("Failed to write response")
+	}
+}
@@ -0,0 +1,172 @@
+package agents
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"k8s.io/test-infra/prow/metrics"
+
+	"github.com/openshift/ci-tools/pkg/api"
+	"github.com/openshift/ci-tools/pkg/load"
+	"github.com/openshift/ci-tools/pkg/testhelper"
+)
+
+func TestRemoteAgents(t *testing.T) {
+	dir := t.TempDir()
+	repoDir := filepath.Join(dir, "org", "repo")
+	if err := os.MkdirAll(repoDir, 0755); err != nil {
+		t.Fatalf("failed to create config dir: %v", err)
+	}
+	write := func(branch string) string {
+		path := filepath.Join(repoDir, "org-repo-"+branch+".yaml")
+		if err := ioutil.WriteFile(path, testhelper.CIOperatorConfig("org", "repo", branch, "unit"), 0644); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+		return path
+	}
+	write("master")
+	write("release-4.9")
+	local, err := newConfigAgent(dir, ConfigAgentOptions{})
+	if err != nil {
+		t.Fatalf("failed to load configs: %v", err)
+	}
+	localRegistry := &registryAgent{
+		lock:         &sync.RWMutex{},
+		registryPath: "../../../test/multistage-registry/registry",
+		flags:        load.RegistryMetadata | load.RegistryDocumentation,
+	}
+	if err := localRegistry.loadRegistry(); err != nil {
+		t.Fatalf("failed to load registry: %v", err)
+	}
+
+	m := &metrics.Metrics{ErrorRate: prometheus.NewCounterVec(prometheus.CounterOpts{}, []string{"error"})}
+	var requestsLock sync.Mutex
+	var requests []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/configs", ServeConfigs(local, m))
+	mux.HandleFunc("/registry", ServeRegistry(localRegistry, m))
+	mux.HandleFunc("/configGeneration", ServeConfigGeneration(local))
+	mux.HandleFunc("/registryGeneration", ServeRegistryGeneration(localRegistry))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestsLock.Lock()
+		requests = append(requests, r.URL.RequestURI())
+		requestsLock.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	// expectRequests checks the requests made since the last check
+	expectRequests := func(expected ...string) {
+		t.Helper()
+		requestsLock.Lock()
+		defer requestsLock.Unlock()
+		if diff := cmp.Diff(expected, requests); diff != "" {
+			t.Errorf("unexpected requests, diff: %v", diff)
+		}
+		requests = nil
+	}
+
+	// the agent does not poll, so the test decides when it syncs
+	remote, err := newRemoteConfigAgent(server.URL+"/", ConfigAgentOptions{})
+	if err != nil {
+		t.Fatalf("failed to create remote config agent: %v", err)
+	}
+	var configAgent ConfigAgent = remote
+	// the configs are only downloaded once they are used
+	expectRequests("/configGeneration")
+	for i := 0; i < 2; i++ {
+		if _, err := configAgent.GetMatchingConfig(api.Metadata{Org: "org", Repo: "repo", Branch: "release-4.9"}); err != nil {
+			t.Errorf("failed to get matching config: %v", err)
+		}
+	}
+	expectRequests("/configs?org=org&repo=repo")
+	if _, err := configAgent.GetMatchingConfig(api.Metadata{Org: "org", Repo: "other", Branch: "master"}); err == nil {
+		t.Error("expected getting a config of an unknown repo to fail")
+	}
+	expectRequests("/configs?org=org&repo=other")
+	if err := configAgent.SetOverlay("org/repo/org-repo-master.yaml", nil); !errors.Is(err, errRemoteAgent) {
+		t.Errorf("expected setting an overlay on a remote agent to fail, got %v", err)
+	}
+
+	// changes drop the configs of repos without downloading them again
+	if err := local.ReloadPaths([]string{write("release-4.10")}); err != nil {
+		t.Fatalf("failed to reload configs: %v", err)
+	}
+	remote.sync()
+	expectRequests("/configGeneration")
+	if generation := configAgent.GetGeneration(); generation != local.GetGeneration() {
+		t.Errorf("expected the generation of the configresolver %d, got %d", local.GetGeneration(), generation)
+	}
+	if _, err := configAgent.GetMatchingConfig(api.Metadata{Org: "org", Repo: "repo", Branch: "release-4.10"}); err != nil {
+		t.Errorf("failed to get matching config after a change: %v", err)
+	}
+	expectRequests("/configs?org=org&repo=repo")
+
+	// the order of configs in a repo is not stable
+	if diff := cmp.Diff(local.GetAll(), configAgent.GetAll(), cmpopts.SortSlices(func(a, b api.ReleaseBuildConfiguration) bool {
+		return a.Metadata.Branch < b.Metadata.Branch
+	})); diff != "" {
+		t.Errorf("remote configs differ from served configs, diff: %v", diff)
+	}
+	expectRequests("/configs")
+	var changes []ConfigChange
+	configAgent.Subscribe(func(change ConfigChange) {
+		changes = append(changes, change)
+	})
+	// once all configs were downloaded, they are kept up to date
+	if err := local.ReloadPaths([]string{write("release-4.11")}); err != nil {
+		t.Fatalf("failed to reload configs: %v", err)
+	}
+	remote.sync()
+	expectRequests("/configGeneration", "/configs")
+	if diff := cmp.Diff([]ConfigChange{{Generation: local.GetGeneration(), Added: []api.Metadata{{Org: "org", Repo: "repo", Branch: "release-4.11"}}}}, changes); diff != "" {
+		t.Errorf("unexpected changes, diff: %v", diff)
+	}
+	if _, err := configAgent.GetMatchingConfig(api.Metadata{Org: "org", Repo: "repo", Branch: "release-4.11"}); err != nil {
+		t.Errorf("failed to get matching config from all configs: %v", err)
+	}
+	expectRequests()
+
+	registryAgent, err := NewRemoteRegistryAgent(server.URL)
+	if err != nil {
+		t.Fatalf("failed to create remote registry agent: %v", err)
+	}
+	if diff := cmp.Diff(localRegistry.GetRegistryContent(), registryAgent.GetRegistryContent()); diff != "" {
+		t.Errorf("remote registry differs from served registry, diff: %v", diff)
+	}
+	workflow := "ipi"
+	config := api.MultiStageTestConfiguration{Workflow: &workflow}
+	expected, err := localRegistry.Resolve("e2e", config)
+	if err != nil {
+		t.Fatalf("failed to resolve locally: %v", err)
+	}
+	resolved, err := registryAgent.Resolve("e2e", config)
+	if err != nil {
+		t.Fatalf("failed to resolve remotely: %v", err)
+	}
+	if diff := cmp.Diff(expected, resolved); diff != "" {
+		t.Errorf("remote resolution differs from local resolution, diff: %v", diff)
+	}
+	if _, err := registryAgent.Node("ipi/ipi-workflow.yaml"); !errors.Is(err, errRemoteAgent) {
+		t.Errorf("expected getting a node from a remote agent to fail, got %v", err)
+	}
+
+	if _, err := NewRemoteRegistryAgent(server.URL + "/missing"); err == nil {
+		t.Error("expected creating an agent for a missing configresolver to fail")
+	}
+	if _, err := NewRemoteConfigAgent(server.URL, WithConfigPartialLoad()); err == nil {
+		t.Error("expected creating a remote config agent with an option for configs on disk to fail")
+	}
+	if _, err := NewRemoteRegistryAgent(server.URL, WithRegistryLayers("layer")); err == nil {
+		t.Error("expected creating a remote registry agent with an option for a registry on disk to fail")
+	}
+}
@@ -0,0 +1,199 @@
+package agents
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/openshift/ci-tools/pkg/api"
+	"github.com/openshift/ci-tools/pkg/registry"
+)
+
+// RegistrySnapshot is an immutable view of the registry of a RegistryAgent at
+// one generation. It stays consistent while the agent reloads, so it can be
+// used for operations that look at the registry more than once. Values that it
+// returns are shared with the agent and must not be modified.
+type RegistrySnapshot struct {
+	generation int
+	references registry.ReferenceByName
+	chains     registry.ChainByName
+	workflows  registry.WorkflowByName
+	observers  registry.ObserverByName
+	// documentation holds the documentation of each component by name
+	documentation map[string]string
+	graph         registry.NodeByName
+	paths         map[string]string
+	resolver      registry.ComponentResolver
+	memo          *resolutionMemo
+}
+
+// Snapshot returns a view of the current state of the registry. Reloads
+// replace the state of the agent instead of modifying it, so no copy is needed.
+func (a *registryAgent) Snapshot() *RegistrySnapshot {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return &RegistrySnapshot{
+		generation:    a.generation,
+		references:    a.references,
+		chains:        a.chains,
+		workflows:     a.workflows,
+		observers:     a.observers,
+		documentation: a.documentation,
+		graph:         a.graph,
+		paths:         a.paths,
+		resolver:      a.resolver,
+		memo:          a.memo,
+	}
+}
+
+// Generation returns the generation of the agent the snapshot was taken at
+func (s *RegistrySnapshot) Generation() int {
+	return s.generation
+}
+
+// Reference returns the reference with the given name
+func (s *RegistrySnapshot) Reference(name string) (api.LiteralTestStep, bool) {
+	reference, ok := s.references[name]
+	return reference, ok
+}
+
+// Chain returns the chain with the given name
+func (s *RegistrySnapshot) Chain(name string) (api.RegistryChain, bool) {
+	chain, ok := s.chains[name]
+	return chain, ok
+}
+
+// Workflow returns the workflow with the given name
+func (s *RegistrySnapshot) Workflow(name string) (api.MultiStageTestConfiguration, bool) {
+	workflow, ok := s.workflows[name]
+	return workflow, ok
+}
+
+// Observer returns the observer with the given name
+func (s *RegistrySnapshot) Observer(name string) (api.Observer, bool) {
+	observer, ok := s.observers[name]
+	return observer, ok
+}
+
+// Names returns the sorted names of the references, chains or workflows
+func (s *RegistrySnapshot) Names(kind registry.Type) ([]string, error) {
+	var names []string
+	switch kind {
+	case registry.Reference:
+		for name := range s.references {
+			names = append(names, name)
+		}
+	case registry.Chain:
+		for name := range s.chains {
+			names = append(names, name)
+		}
+	case registry.Workflow:
+		for name := range s.workflows {
+			names = append(names, name)
+		}
+	default:
+		return nil, fmt.Errorf("unknown registry component type %s", kind)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ObserverNames returns the sorted names of the observers
+func (s *RegistrySnapshot) ObserverNames() []string {
+	var names []string
+	for name := range s.observers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Path returns the file that defines the component, named by its kind and name
+// like "chain/ipi-install". It is empty if the file is not known.
+func (s *RegistrySnapshot) Path(component string) string {
+	return s.paths[component]
+}
+
+// WhoReferences returns the chains and workflows that directly reference the
+// registry component with the given name and type, sorted by type and name.
+func (s *RegistrySnapshot) WhoReferences(name string, kind registry.Type) ([]registry.Node, error) {
+	var nodes map[string]registry.Node
+	switch kind {
+	case registry.Reference:
+		nodes = s.graph.References
+	case registry.Chain:
+		nodes = s.graph.Chains
+	case registry.Workflow:
+		nodes = s.graph.Workflows
+	default:
+		return nil, fmt.Errorf("unknown registry component type %s", kind)
+	}
+	node, exists := nodes[name]
+	if !exists {
+		return nil, fmt.Errorf("no %s named %s", kind, name)
+	}
+	parents := node.Parents()
+	sort.Slice(parents, func(i, j int) bool {
+		if parents[i].Type() != parents[j].Type() {
+			return parents[i].Type() < parents[j].Type()
+		}
+		return parents[i].Name() < parents[j].Name()
+	})
+	return parents, nil
+}
+
+// Resolve resolves a multi-stage test using the registry of the snapshot. Tests
+// are resolved once per generation and configuration, and the result is shared
+// between callers.
+func (s *RegistrySnapshot) Resolve(name string, config api.MultiStageTestConfiguration) (api.MultiStageTestConfigurationLiteral, error) {
+	return s.memo.test(name, config, func() (api.MultiStageTestConfigurationLiteral, error) {
+		return s.resolver.Resolve(name, config)
+	})
+}
+
+// ResolveChain returns the steps that the chain with the given name expands to.
+// Chains are resolved once per generation, and the steps are shared between
+// callers.
+func (s *RegistrySnapshot) ResolveChain(name string) ([]api.LiteralTestStep, error) {
+	return s.memo.chain(name, func() ([]api.LiteralTestStep, error) {
+		return s.resolver.ResolveChain(name)
+	})
+}
+
+// ResolveWorkflow returns what the workflow with the given name expands to.
+// Workflows are resolved once per generation, and the result is shared between
+// callers.
+func (s *RegistrySnapshot) ResolveWorkflow(name string) (api.MultiStageTestConfigurationLiteral, error) {
+	return s.memo.workflow(name, func() (api.MultiStageTestConfigurationLiteral, error) {
+		return s.resolver.ResolveWorkflow(name)
+	})
+}
+
+// ResolveTest resolves a multi-stage test like RegistryAgent.ResolveTest does,
+// using the registry of the snapshot
+func (s *RegistrySnapshot) ResolveTest(name string, config api.MultiStageTestConfiguration) (api.MultiStageTestConfigurationLiteral, map[string]FieldSource, error) {
+	resolved, provenance, err := s.memo.testWithProvenance(name, config, func() (api.MultiStageTestConfigurationLiteral, registry.Provenance, error) {
+		return s.resolver.ResolveWithProvenance(name, config)
+	})
+	if err != nil {
+		return api.MultiStageTestConfigurationLiteral{}, nil, err
+	}
+	sources := make(map[string]FieldSource, len(provenance))
+	for field, component := range provenance {
+		sources[field] = FieldSource{Component: component, Path: s.paths[component]}
+	}
+	return resolved, sources, nil
+}
+
+// copyingResolver resolves tests with a snapshot into copies, which callers
+// may modify unlike the tests that the snapshot shares between them
+type copyingResolver struct {
+	snapshot *RegistrySnapshot
+}
+
+func (r copyingResolver) Resolve(name string, config api.MultiStageTestConfiguration) (api.MultiStageTestConfigurationLiteral, error) {
+	resolved, err := r.snapshot.Resolve(name, config)
+	if err != nil {
+		return api.MultiStageTestConfigurationLiteral{}, err
+	}
+	return *resolved.DeepCopy(), nil
+}
@@ -3,6 +3,10 @@ package agents
 import (
 	"context"
 	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
 
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
@@ -10,8 +14,94 @@ import (
 
 	"k8s.io/test-infra/prow/config"
 	"k8s.io/test-infra/prow/interrupts"
+
+	"github.com/openshift/ci-tools/pkg/load"
 )
 
+// overlayPath maps path onto root, so that it matches the paths that are
+// encountered when loading files from root
+func overlayPath(root, path string) (string, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", fmt.Errorf("failed to determine absolute path for %s: %w", root, err)
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to determine absolute path for %s: %w", path, err)
+	}
+	if !isUnder(absRoot, absPath) {
+		return "", fmt.Errorf("%s is not under %s", path, root)
+	}
+	rel, err := filepath.Rel(absRoot, absPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to determine relative path for %s: %w", path, err)
+	}
+	return filepath.Join(root, rel), nil
+}
+
+// isUnder determines whether path is root or below it
+func isUnder(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// fuzzyMatch determines whether value matches query, ignoring case, and how
+// well: an exact match scores 3, a prefix 2, a substring 1 and a value that
+// only contains the characters of query in order scores 0
+func fuzzyMatch(query, value string) (int, bool) {
+	query, value = strings.ToLower(query), strings.ToLower(value)
+	switch {
+	case query == value:
+		return 3, true
+	case strings.HasPrefix(value, query):
+		return 2, true
+	case strings.Contains(value, query):
+		return 1, true
+	}
+	remaining := query
+	for _, r := range value {
+		if remaining == "" {
+			break
+		}
+		if next, size := utf8.DecodeRuneInString(remaining); r == next {
+			remaining = remaining[size:]
+		}
+	}
+	return 0, remaining == ""
+}
+
+// updateOverlay sets the overlay content for path, or removes it if remove is set,
+// and reloads path. If the reload fails, the previous overlay content is restored.
+func updateOverlay(lock *sync.RWMutex, overlay *load.Overlay, root, path string, content []byte, remove bool, reload func(paths []string) error) error {
+	key, err := overlayPath(root, path)
+	if err != nil {
+		return err
+	}
+	lock.Lock()
+	if *overlay == nil {
+		*overlay = load.Overlay{}
+	}
+	previous, hadPrevious := (*overlay)[key]
+	if remove {
+		delete(*overlay, key)
+	} else {
+		(*overlay)[key] = content
+	}
+	lock.Unlock()
+
+	if err := reload([]string{key}); err != nil {
+		lock.Lock()
+		if hadPrevious {
+			(*overlay)[key] = previous
+		} else {
+			delete(*overlay, key)
+		}
+		lock.Unlock()
+		return fmt.Errorf("failed to reload with overlay for %s: %w", path, err)
+	}
+	return nil
+}
+
 func startWatchers(path string, callback func() error, recordError func(string)) error {
 	cms, dirs, err := config.ListCMsAndDirs(path)
 	if err != nil {
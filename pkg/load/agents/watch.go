@@ -0,0 +1,161 @@
+package agents
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/fsnotify.v1"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/test-infra/prow/config"
+	"k8s.io/test-infra/prow/interrupts"
+)
+
+const (
+	// coalescePeriod is how long watchChanges waits for further changes after
+	// a change before reloading all changed paths at once, so that bursts of
+	// changes like a git checkout cause a single reload instead of one per file
+	coalescePeriod = 200 * time.Millisecond
+	// maxCoalescePeriod is how long watchChanges waits at most after the first
+	// change, so that constant changes do not delay reloads forever
+	maxCoalescePeriod = 2 * time.Second
+	// maxReloadPaths is the number of changed paths above which watchChanges
+	// reloads everything, which is cheaper than reloading that many paths
+	maxReloadPaths = 100
+)
+
+// watchChanges watches the directories at or below root and reloads only the
+// files that changed with reloadPaths. Configmap mounts are reloaded with
+// reload instead, as all of their files are replaced at once. Changes are
+// collected while a reload runs and reloaded together once it finished.
+func watchChanges(root string, reload func() error, reloadPaths func([]string) error, recordError func(string)) error {
+	cms, dirs, err := config.ListCMsAndDirs(root)
+	if err != nil {
+		return err
+	}
+	errFunc := func(err error, msg string) {
+		recordError(msg)
+		logrus.WithError(err).Error(msg)
+	}
+	for cm := range cms {
+		watcher, err := config.GetCMMountWatcher(reload, errFunc, cm)
+		if err != nil {
+			return err
+		}
+		interrupts.Run(watcher)
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %w", err)
+	}
+	for dir := range dirs {
+		if err := w.Add(dir); err != nil {
+			return fmt.Errorf("failed to watch %s: %w", dir, err)
+		}
+	}
+	// the reloads run separately from the event loop, so that events are
+	// not left unread while they run
+	var pendingLock sync.Mutex
+	pending := sets.NewString()
+	ready := make(chan struct{}, 1)
+	interrupts.Run(func(ctx context.Context) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ready:
+			}
+			pendingLock.Lock()
+			paths := pending.List()
+			pending = sets.NewString()
+			pendingLock.Unlock()
+			logrus.WithField("paths", len(paths)).Debug("Reloading changed paths")
+			if len(paths) > maxReloadPaths {
+				if err := reload(); err != nil {
+					errFunc(err, "failed to reload")
+				}
+				continue
+			}
+			if err := reloadPaths(paths); err != nil {
+				errFunc(err, "failed to reload changed paths")
+			}
+		}
+	})
+	interrupts.Run(func(ctx context.Context) {
+		changed := sets.NewString()
+		var timer *time.Timer
+		var flush <-chan time.Time
+		var deadline time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				if timer != nil {
+					timer.Stop()
+				}
+				if err := w.Close(); err != nil {
+					errFunc(err, "failed to close watcher")
+				}
+				return
+			case event := <-w.Events:
+				if event.Op&fsnotify.Create != 0 {
+					// watch new directories and the ones below them
+					if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+						_, dirs, err := config.ListCMsAndDirs(event.Name)
+						if err != nil {
+							errFunc(err, "failed to list new directories")
+						}
+						for dir := range dirs {
+							if err := w.Add(dir); err != nil {
+								errFunc(err, "failed to watch new directory")
+							}
+						}
+					}
+				}
+				changed.Insert(event.Name)
+				wait := coalescePeriod
+				if timer == nil {
+					deadline = time.Now().Add(maxCoalescePeriod)
+				} else {
+					timer.Stop()
+					if remaining := time.Until(deadline); remaining < wait {
+						wait = remaining
+					}
+				}
+				timer = time.NewTimer(wait)
+				flush = timer.C
+			case <-flush:
+				timer, flush = nil, nil
+				pendingLock.Lock()
+				pending.Insert(changed.UnsortedList()...)
+				pendingLock.Unlock()
+				changed = sets.NewString()
+				select {
+				case ready <- struct{}{}:
+				default:
+					// a reload is pending already and picks up these paths
+				}
+			case err := <-w.Errors:
+				errFunc(err, "received fsnotify error")
+			}
+		}
+	})
+	return nil
+}
+
+// pollReloads runs reload at the given interval, unless it is zero, to pick up
+// changes that watchers missed
+func pollReloads(reload func() error, interval time.Duration, recordError func(string)) {
+	if interval == 0 {
+		return
+	}
+	interrupts.TickLiteral(func() {
+		if err := reload(); err != nil {
+			recordError("failed to reload")
+			logrus.WithError(err).Error("Failed to reload")
+		}
+	}, interval)
+}
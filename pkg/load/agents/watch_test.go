@@ -0,0 +1,190 @@
+package agents
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"github.com/openshift/ci-tools/pkg/testhelper"
+)
+
+func TestConfigAgentWatch(t *testing.T) {
+	dir := t.TempDir()
+	write := func(path, branch string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, path), testhelper.CIOperatorConfig("org", "repo", branch, "unit"), 0644); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+	}
+	write("org/repo/org-repo-master.yaml", "master")
+	agent, err := NewConfigAgent(dir, WithConfigWatch(0))
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	branches := func() []string {
+		var branches []string
+		for _, config := range agent.GetAll()["org"]["repo"] {
+			branches = append(branches, config.Metadata.Branch)
+		}
+		sort.Strings(branches)
+		return branches
+	}
+	// waitFor waits until the agent has the configs of the expected branches
+	waitFor := func(expected []string) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			if cmp.Equal(expected, branches()) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("agent did not pick up changes, diff: %s", cmp.Diff(expected, branches()))
+	}
+
+	write("org/repo/org-repo-release-4.9.yaml", "release-4.9")
+	waitFor([]string{"master", "release-4.9"})
+	// files in new directories are picked up as well
+	write("org/repo/nested/org-repo-release-4.10.yaml", "release-4.10")
+	waitFor([]string{"master", "release-4.10", "release-4.9"})
+	if err := os.Remove(filepath.Join(dir, "org/repo/org-repo-master.yaml")); err != nil {
+		t.Fatalf("failed to remove config: %v", err)
+	}
+	waitFor([]string{"release-4.10", "release-4.9"})
+}
+
+func TestWatchChangesCoalesces(t *testing.T) {
+	dir := t.TempDir()
+	lock := &sync.Mutex{}
+	var calls [][]string
+	var fullReloads int
+	reload := func() error {
+		lock.Lock()
+		defer lock.Unlock()
+		fullReloads++
+		return nil
+	}
+	reloadPaths := func(paths []string) error {
+		lock.Lock()
+		defer lock.Unlock()
+		calls = append(calls, paths)
+		return nil
+	}
+	if err := watchChanges(dir, reload, reloadPaths, func(string) {}); err != nil {
+		t.Fatalf("failed to watch: %v", err)
+	}
+	var expected []string
+	for i := 0; i < 5; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("file-%d.yaml", i))
+		if err := ioutil.WriteFile(path, []byte("content"), 0644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+		expected = append(expected, path)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		lock.Lock()
+		reloaded := sets.NewString()
+		for _, paths := range calls {
+			reloaded.Insert(paths...)
+		}
+		count := len(calls)
+		lock.Unlock()
+		if reloaded.Equal(sets.NewString(expected...)) {
+			// the files are written well within one period
+			if count != 1 {
+				t.Errorf("expected the changes to be reloaded at once, got %d reloads", count)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("changes were not reloaded, diff: %s", cmp.Diff(expected, reloaded.List()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if fullReloads != 0 {
+		t.Errorf("expected no full reload for few changes, got %d", fullReloads)
+	}
+}
+
+func TestWatchChangesDebounces(t *testing.T) {
+	dir := t.TempDir()
+	reloaded := make(chan time.Time, 100)
+	reloadPaths := func([]string) error {
+		reloaded <- time.Now()
+		return nil
+	}
+	if err := watchChanges(dir, func() error { return nil }, reloadPaths, func(string) {}); err != nil {
+		t.Fatalf("failed to watch: %v", err)
+	}
+	// changes arrive faster than the coalesce period for longer than the
+	// maximal period
+	start := time.Now()
+	for i := 0; time.Since(start) < maxCoalescePeriod+time.Second; i++ {
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file-%d.yaml", i)), []byte("content"), 0644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+		time.Sleep(coalescePeriod / 4)
+	}
+	end := time.Now()
+	select {
+	case first := <-reloaded:
+		if first.Sub(start) < maxCoalescePeriod/2 {
+			t.Errorf("expected changes to delay the reload, got one after %s", first.Sub(start))
+		}
+		if first.After(end) {
+			t.Errorf("expected a reload before the changes stopped, got one %s after", first.Sub(end))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("changes were not reloaded")
+	}
+}
+
+func TestWatchedRoots(t *testing.T) {
+	for _, testCase := range []struct {
+		name     string
+		roots    []string
+		expected []string
+	}{
+		{
+			name:     "separate roots are all watched",
+			roots:    []string{"/registry", "/private"},
+			expected: []string{"/registry", "/private"},
+		},
+		{
+			name:     "layer nested in the registry is covered by it",
+			roots:    []string{"/registry", "/registry/private"},
+			expected: []string{"/registry"},
+		},
+		{
+			name:     "registry nested in a layer is covered by it",
+			roots:    []string{"/registry/public", "/registry"},
+			expected: []string{"/registry"},
+		},
+		{
+			name:     "equal roots are watched once",
+			roots:    []string{"/registry", "/registry/"},
+			expected: []string{"/registry"},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			if diff := cmp.Diff(testCase.expected, watchedRoots(testCase.roots)); diff != "" {
+				t.Errorf("unexpected watched roots, diff: %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package load
+
+import (
+	"crypto/sha256"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/test-infra/prow/repoowners"
+
+	"github.com/openshift/ci-tools/pkg/api"
+)
+
+// ParseCache holds parsed configs and registry files keyed by their path, so
+// that files whose content did not change are not parsed again. Loads remove
+// the files that no longer exist from it. It hands out deep copies, so callers
+// cannot modify what it holds. It is safe for concurrent use, and a nil
+// ParseCache parses every file.
+type ParseCache struct {
+	lock     sync.Mutex
+	configs  map[string]cachedConfig
+	registry map[string]cachedRegistryFile
+	record   func(kind string, hit bool)
+}
+
+type cachedConfig struct {
+	hash   [sha256.Size]byte
+	config api.ReleaseBuildConfiguration
+}
+
+type cachedRegistryFile struct {
+	hash [sha256.Size]byte
+	// commandsHash is the hash of the commands file of a reference or observer
+	commandsHash [sha256.Size]byte
+	file         *registryFile
+}
+
+// NewParseCache returns an empty cache. Unless record is nil, it is called for
+// every lookup with the kind of file, "config" or "registry", and whether the
+// file was found in the cache.
+func NewParseCache(record func(kind string, hit bool)) *ParseCache {
+	return &ParseCache{
+		configs:  map[string]cachedConfig{},
+		registry: map[string]cachedRegistryFile{},
+		record:   record,
+	}
+}
+
+func (c *ParseCache) recordLookup(kind string, hit bool) {
+	if c.record != nil {
+		c.record(kind, hit)
+	}
+}
+
+// config returns the config in the file at path with the content raw, parsing
+// it with parse unless it is cached
+func (c *ParseCache) config(path string, raw []byte, parse func(string, []byte) (*api.ReleaseBuildConfiguration, error)) (*api.ReleaseBuildConfiguration, error) {
+	if c == nil {
+		return parse(path, raw)
+	}
+	hash := sha256.Sum256(raw)
+	c.lock.Lock()
+	cached, ok := c.configs[path]
+	c.lock.Unlock()
+	if ok && cached.hash == hash {
+		c.recordLookup("config", true)
+		return cached.config.DeepCopy(), nil
+	}
+	c.recordLookup("config", false)
+	config, err := parse(path, raw)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	c.configs[path] = cachedConfig{hash: hash, config: *config.DeepCopy()}
+	c.lock.Unlock()
+	return config, nil
+}
+
+// registryFile returns the registry file at path with the content raw, using
+// parse if it is not in the cache. Files with a commands file are only taken
+// from the cache if the content of the commands file did not change either.
+func (c *ParseCache) registryFile(path string, raw []byte, overlay Overlay, parse func(string, []byte, Overlay) (*registryFile, error)) (*registryFile, error) {
+	if c == nil {
+		return parse(path, raw, overlay)
+	}
+	hash := sha256.Sum256(raw)
+	c.lock.Lock()
+	cached, ok := c.registry[path]
+	c.lock.Unlock()
+	if ok && cached.hash == hash && c.commandsUnchanged(cached, overlay) {
+		c.recordLookup("registry", true)
+		return cached.file.deepCopy(), nil
+	}
+	c.recordLookup("registry", false)
+	file, err := parse(path, raw, overlay)
+	if err != nil {
+		return nil, err
+	}
+	entry := cachedRegistryFile{hash: hash, file: file.deepCopy()}
+	if file != nil && file.commands != "" {
+		commands, err := overlay.ReadFile(file.commands)
+		if err != nil {
+			// the file was parsed, so the commands should be readable; just do not cache it
+			return file, nil
+		}
+		entry.commandsHash = sha256.Sum256(commands)
+	}
+	c.lock.Lock()
+	c.registry[path] = entry
+	c.lock.Unlock()
+	return file, nil
+}
+
+// deepCopy returns a copy of the file that shares nothing with it but strings
+func (f *registryFile) deepCopy() *registryFile {
+	if f == nil {
+		return nil
+	}
+	out := *f
+	out.reference = f.reference.DeepCopy()
+	out.chain = f.chain.DeepCopy()
+	out.workflow = f.workflow.DeepCopy()
+	out.observer = f.observer.DeepCopy()
+	if f.metadata != nil {
+		owners := f.metadata.Owners
+		out.metadata = &api.RegistryInfo{
+			Path: f.metadata.Path,
+			Owners: repoowners.Config{
+				Approvers:         append([]string(nil), owners.Approvers...),
+				Reviewers:         append([]string(nil), owners.Reviewers...),
+				RequiredReviewers: append([]string(nil), owners.RequiredReviewers...),
+				Labels:            append([]string(nil), owners.Labels...),
+			},
+		}
+	}
+	return &out
+}
+
+func (c *ParseCache) commandsUnchanged(cached cachedRegistryFile, overlay Overlay) bool {
+	if cached.file == nil || cached.file.commands == "" {
+		return true
+	}
+	commands, err := overlay.ReadFile(cached.file.commands)
+	return err == nil && sha256.Sum256(commands) == cached.commandsHash
+}
+
+// prune removes the files at or below any of roots that are not in keep, like
+// files that were removed or renamed since they were cached
+func (c *ParseCache) prune(roots []string, keep sets.String) {
+	if c == nil {
+		return
+	}
+	under := func(path string) bool {
+		for _, root := range roots {
+			if isUnder(root, path) {
+				return true
+			}
+		}
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for path := range c.configs {
+		if !keep.Has(path) && under(path) {
+			delete(c.configs, path)
+		}
+	}
+	for path := range c.registry {
+		if !keep.Has(path) && under(path) {
+			delete(c.registry, path)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package load
+
+import (
+	"reflect"
+	"sync"
+)
+
+// Interner deduplicates equal strings in loaded configs and registry
+// components, so that strings repeated across files, like the names of
+// images, steps or branches, are only kept in memory once. It is safe for
+// concurrent use: the lock is only held to look up single strings, so values
+// are interned concurrently.
+type Interner struct {
+	lock    sync.RWMutex
+	strings map[string]string
+}
+
+// NewInterner returns an Interner that has not seen any strings yet
+func NewInterner() *Interner {
+	return &Interner{strings: map[string]string{}}
+}
+
+// String returns the first string the Interner has seen that is equal to s
+func (i *Interner) String(s string) string {
+	i.lock.RLock()
+	interned, ok := i.strings[s]
+	i.lock.RUnlock()
+	if ok {
+		return interned
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if interned, ok := i.strings[s]; ok {
+		return interned
+	}
+	i.strings[s] = s
+	return s
+}
+
+// lookup returns the string equal to s that the Interner has seen, if any
+func (i *Interner) lookup(s string) (string, bool) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	interned, ok := i.strings[s]
+	return interned, ok
+}
+
+// Intern replaces all strings that can be set in the value that value points
+// to, including the ones in nested structs, slices, maps and pointers, with
+// the first equal string the Interner has seen. Unexported fields and values
+// of interfaces are left unchanged.
+func (i *Interner) Intern(value interface{}) {
+	i.intern(reflect.ValueOf(value))
+}
+
+func (i *Interner) intern(value reflect.Value) {
+	switch value.Kind() {
+	case reflect.Ptr:
+		if !value.IsNil() {
+			i.intern(value.Elem())
+		}
+	case reflect.String:
+		if value.CanSet() {
+			value.SetString(i.String(value.String()))
+		}
+	case reflect.Struct:
+		for field := 0; field < value.NumField(); field++ {
+			if value.Field(field).CanSet() {
+				i.intern(value.Field(field))
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for index := 0; index < value.Len(); index++ {
+			i.intern(value.Index(index))
+		}
+	case reflect.Map:
+		// map entries cannot be modified in place, so intern copies of them
+		// and replace the entries with those
+		for _, key := range value.MapKeys() {
+			item := reflect.New(value.Type().Elem()).Elem()
+			item.Set(value.MapIndex(key))
+			i.intern(item)
+			internedKey := reflect.New(value.Type().Key()).Elem()
+			internedKey.Set(key)
+			i.intern(internedKey)
+			value.SetMapIndex(key, reflect.Value{})
+			value.SetMapIndex(internedKey, item)
+		}
+	}
+}
+
+// Retain forgets the strings the Interner has seen that are not in the values,
+// like the ones of configs or components that no longer exist. The values are
+// walked like Intern does, but are not modified. Strings that are interned
+// concurrently may be forgotten, which only means that they are not shared
+// with strings interned later.
+func (i *Interner) Retain(values ...interface{}) {
+	retained := map[string]string{}
+	for _, value := range values {
+		i.retain(reflect.ValueOf(value), retained)
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.strings = retained
+}
+
+func (i *Interner) retain(value reflect.Value, retained map[string]string) {
+	switch value.Kind() {
+	case reflect.Ptr:
+		if !value.IsNil() {
+			i.retain(value.Elem(), retained)
+		}
+	case reflect.String:
+		if interned, ok := i.lookup(value.String()); ok {
+			retained[interned] = interned
+		}
+	case reflect.Struct:
+		for field := 0; field < value.NumField(); field++ {
+			if value.Type().Field(field).IsExported() {
+				i.retain(value.Field(field), retained)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for index := 0; index < value.Len(); index++ {
+			i.retain(value.Index(index), retained)
+		}
+	case reflect.Map:
+		for _, key := range value.MapKeys() {
+			i.retain(key, retained)
+			i.retain(value.MapIndex(key), retained)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package load
+
+import (
+	"reflect"
+	"testing"
+	"unsafe"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/openshift/ci-tools/pkg/api"
+)
+
+func TestInterner(t *testing.T) {
+	// build the strings at runtime so that they do not share memory already
+	name := func() string { return string([]byte("ipi-install")) }
+	data := func(s string) uintptr {
+		return (*reflect.StringHeader)(unsafe.Pointer(&s)).Data
+	}
+	first := &api.LiteralTestStep{As: name(), Environment: []api.StepParameter{{Name: name()}}}
+	second := &api.RegistryChain{
+		As:          name(),
+		Steps:       []api.TestStep{{Reference: func() *string { s := name(); return &s }()}},
+		Environment: []api.StepParameter{{Name: "SIZE", Default: func() *string { s := name(); return &s }()}},
+	}
+	env := api.TestEnvironment{name(): name()}
+	expected := api.TestEnvironment{"ipi-install": "ipi-install"}
+
+	interner := NewInterner()
+	interner.Intern(first)
+	interner.Intern(second)
+	interner.Intern(env)
+
+	shared := data(first.As)
+	for _, s := range []string{first.Environment[0].Name, second.As, *second.Steps[0].Reference, *second.Environment[0].Default, interner.String(name())} {
+		if data(s) != shared {
+			t.Errorf("expected %q to share its memory with the first equal string", s)
+		}
+	}
+	for key, value := range env {
+		if data(key) != shared || data(value) != shared {
+			t.Error("expected the keys and values of maps to share their memory with the first equal string")
+		}
+	}
+	if diff := cmp.Diff(expected, env); diff != "" {
+		t.Errorf("interning changed the map, diff: %s", diff)
+	}
+
+	removed := string([]byte("removed"))
+	interner.String(removed)
+	interner.Retain(first)
+	if data(interner.String(name())) != shared {
+		t.Error("expected the strings of retained values to stay interned")
+	}
+	if again := string([]byte("removed")); data(interner.String(again)) != data(again) {
+		t.Error("expected the strings of values that were not retained to be forgotten")
+	}
+}
@@ -8,13 +8,17 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 
 	"github.com/sirupsen/logrus"
-	"golang.org/x/sync/errgroup"
 
 	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/test-infra/prow/config"
 	"sigs.k8s.io/yaml"
 
@@ -46,16 +50,118 @@ const (
 // ByOrgRepo maps org --> repo --> list of branched and variant configs
 type ByOrgRepo map[string]map[string][]api.ReleaseBuildConfiguration
 
+// Overlay maps file paths to in-memory contents. When loading configurations or
+// the step registry, contents in an overlay take precedence over the files on
+// disk, and paths that only exist in the overlay are loaded as well.
+type Overlay map[string][]byte
+
+// FileError is an error in loading a single file
+type FileError struct {
+	Path string
+	// Line is the line of the file the error is on, starting at 1, or 0 if the
+	// error is not about a specific line
+	Line int
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+var yamlLineRegexp = regexp.MustCompile(`yaml: line (\d+):`)
+
+// newFileError determines the line that err is on from YAML syntax errors
+func newFileError(path string, err error) *FileError {
+	fileErr := &FileError{Path: path, Err: err}
+	if match := yamlLineRegexp.FindStringSubmatch(err.Error()); match != nil {
+		fileErr.Line, _ = strconv.Atoi(match[1])
+	}
+	return fileErr
+}
+
+// FileErrors returns the errors about single files in err, which may be an
+// aggregate, and an aggregate of all other errors in err
+func FileErrors(err error) ([]*FileError, error) {
+	if err == nil {
+		return nil, nil
+	}
+	var aggregate utilerrors.Aggregate
+	if errors.As(err, &aggregate) {
+		var fileErrors []*FileError
+		var others []error
+		for _, err := range aggregate.Errors() {
+			nestedFileErrors, nestedOthers := FileErrors(err)
+			fileErrors = append(fileErrors, nestedFileErrors...)
+			if nestedOthers != nil {
+				others = append(others, nestedOthers)
+			}
+		}
+		return fileErrors, utilerrors.NewAggregate(others)
+	}
+	var fileErr *FileError
+	if errors.As(err, &fileErr) {
+		return []*FileError{fileErr}, nil
+	}
+	return nil, err
+}
+
+// ReadFile returns the overlay content for path if there is any and the
+// content of the file on disk otherwise
+func (o Overlay) ReadFile(path string) ([]byte, error) {
+	if raw, ok := o[filepath.Clean(path)]; ok {
+		return raw, nil
+	}
+	return gzip.ReadFileMaybeGZIP(path)
+}
+
+// exists determines whether path is in the overlay or on disk
+func (o Overlay) exists(path string) bool {
+	if _, ok := o[filepath.Clean(path)]; ok {
+		return true
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// pathsUnder returns the overlay paths at or below root that are not in seen
+func (o Overlay) pathsUnder(root string, seen sets.String) []string {
+	var paths []string
+	for path := range o {
+		if !seen.Has(path) && isUnder(root, path) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// isUnder determines whether path is root or below it
+func isUnder(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
 func FromPathByOrgRepo(path string) (ByOrgRepo, error) {
-	byFilename, err := fromPath(path)
+	return FromPathByOrgRepoWithOverlay(path, nil)
+}
+
+// FromPathByOrgRepoWithOverlay loads all configs found at or below the given
+// path, preferring the contents in the overlay over the files on disk.
+func FromPathByOrgRepoWithOverlay(path string, overlay Overlay) (ByOrgRepo, error) {
+	byFilename, err := fromPath(path, overlay)
 	if err != nil {
 		return nil, err
 	}
 
-	return partitionByOrgRepo(byFilename), nil
+	return PartitionByOrgRepo(byFilename), nil
 }
 
-func partitionByOrgRepo(byFilename filenameToConfig) ByOrgRepo {
+// PartitionByOrgRepo groups configs, keyed by their file, by org and repo
+func PartitionByOrgRepo(byFilename map[string]api.ReleaseBuildConfiguration) ByOrgRepo {
 	byOrgRepo := map[string]map[string][]api.ReleaseBuildConfiguration{}
 	for _, configuration := range byFilename {
 		org, repo := configuration.Metadata.Org, configuration.Metadata.Repo
@@ -74,47 +180,146 @@ func partitionByOrgRepo(byFilename filenameToConfig) ByOrgRepo {
 type filenameToConfig map[string]api.ReleaseBuildConfiguration
 
 // FromPath returns all configs found at or below the given path
-func fromPath(path string) (filenameToConfig, error) {
-	configs := filenameToConfig{}
+func fromPath(path string, overlay Overlay) (filenameToConfig, error) {
+	byPath, err := ConfigsByPath(path, overlay)
+	configs := make(filenameToConfig, len(byPath))
+	for path, configSpec := range byPath {
+		configs[filepath.Base(path)] = configSpec
+	}
+	return configs, err
+}
+
+// ConfigsByPath returns all configs found at or below the given path keyed by
+// the path of their file, preferring the contents in the overlay over the
+// files on disk.
+func ConfigsByPath(path string, overlay Overlay) (map[string]api.ReleaseBuildConfiguration, error) {
+	return configsByPath(path, overlay, ConfigLoadOptions{})
+}
+
+// UnvalidatedConfigsByPath loads configs like ConfigsByPath does, but does not
+// validate them
+func UnvalidatedConfigsByPath(path string, overlay Overlay) (map[string]api.ReleaseBuildConfiguration, error) {
+	return ConfigsByPathWithOptions(path, overlay, ConfigLoadOptions{SkipValidation: true})
+}
+
+// ConfigLoadOptions determine how ConfigsByPathWithOptions loads configs
+type ConfigLoadOptions struct {
+	// SkipValidation disables validating the configs
+	SkipValidation bool
+	// Cache holds configs parsed by earlier loads, which are reused for files
+	// whose content did not change
+	Cache *ParseCache
+	// Interner deduplicates the strings of the loaded configs
+	Interner *Interner
+}
+
+// ConfigsByPathWithOptions loads configs like ConfigsByPath does, using the options
+func ConfigsByPathWithOptions(path string, overlay Overlay, options ConfigLoadOptions) (map[string]api.ReleaseBuildConfiguration, error) {
+	return configsByPath(path, overlay, options)
+}
+
+func configsByPath(path string, overlay Overlay, options ConfigLoadOptions) (map[string]api.ReleaseBuildConfiguration, error) {
+	configs := map[string]api.ReleaseBuildConfiguration{}
 	lock := &sync.Mutex{}
-	errGroup := &errgroup.Group{}
+	seen := sets.NewString()
 
-	err := filepath.WalkDir(path, func(path string, info fs.DirEntry, err error) error {
-		if info == nil || err != nil {
-			// file may not exist due to race condition between the reload and k8s removing deleted/moved symlinks in a confimap directory; ignore it
-			if os.IsNotExist(err) {
-				return nil
+	loadFile := func(path string) error {
+		raw, err := overlay.ReadFile(path)
+		if err != nil {
+			return newFileError(path, fmt.Errorf("failed to load ci-operator config (%w)", err))
+		}
+		// cached configs are shared with earlier loads, so they are interned
+		// when they are parsed and never modified afterwards
+		configSpec, err := options.Cache.config(path, raw, func(path string, raw []byte) (*api.ReleaseBuildConfiguration, error) {
+			configSpec, err := configFromBytes(raw, path)
+			if err == nil && options.Interner != nil {
+				options.Interner.Intern(configSpec)
 			}
-			return err
+			return configSpec, err
+		})
+		if err != nil {
+			return newFileError(path, fmt.Errorf("failed to load ci-operator config (%w)", err))
 		}
-		if strings.HasPrefix(info.Name(), "..") {
-			if info.IsDir() {
-				return filepath.SkipDir
+
+		if !options.SkipValidation {
+			if err := validation.IsValidRuntimeConfiguration(configSpec); err != nil {
+				return newFileError(path, fmt.Errorf("invalid ci-operator config: %w", err))
 			}
-			return nil
 		}
-		errGroup.Go(func() error {
-			ext := filepath.Ext(path)
-			if !info.IsDir() && (ext == ".yml" || ext == ".yaml") {
-				configSpec, err := Config(path, "", "", nil, nil)
-				if err != nil {
-					return fmt.Errorf("failed to load ci-operator config (%w)", err)
-				}
+		logrus.Tracef("Adding %s to filenameToConfig", filepath.Base(path))
+		lock.Lock()
+		configs[path] = *configSpec
+		lock.Unlock()
+		return nil
+	}
+	// collect the errors of all files rather than only the first one
+	var fileErrors []error
+	loadFileCollectingErrors := func(path string) {
+		if err := loadFile(path); err != nil {
+			lock.Lock()
+			fileErrors = append(fileErrors, err)
+			lock.Unlock()
+		}
+	}
 
-				if err := validation.IsValidRuntimeConfiguration(configSpec); err != nil {
-					return fmt.Errorf("invalid ci-operator config: %w", err)
+	// walk while the files that were already found are loaded, handing them
+	// to a bounded number of workers so that only as many files as there are
+	// workers are held in memory at once
+	paths := make(chan string)
+	var err error
+	go func() {
+		defer close(paths)
+		err = filepath.WalkDir(path, func(path string, info fs.DirEntry, err error) error {
+			if info == nil || err != nil {
+				// file may not exist due to race condition between the reload and k8s removing deleted/moved symlinks in a confimap directory; ignore it
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if strings.HasPrefix(info.Name(), "..") {
+				if info.IsDir() {
+					return filepath.SkipDir
 				}
-				logrus.Tracef("Adding %s to filenameToConfig", filepath.Base(path))
-				lock.Lock()
-				configs[filepath.Base(path)] = *configSpec
-				lock.Unlock()
+				return nil
+			}
+			if ext := filepath.Ext(path); !info.IsDir() && (ext == ".yml" || ext == ".yaml") {
+				seen.Insert(path)
+				paths <- path
 			}
 			return nil
 		})
-		return nil
+		for _, path := range overlay.pathsUnder(path, seen) {
+			if ext := filepath.Ext(path); ext == ".yml" || ext == ".yaml" {
+				seen.Insert(path)
+				paths <- path
+			}
+		}
+	}()
+	loadConcurrently(paths, loadFileCollectingErrors)
+	options.Cache.prune([]string{path}, seen)
+	sort.Slice(fileErrors, func(i, j int) bool {
+		return fileErrors[i].(*FileError).Path < fileErrors[j].(*FileError).Path
 	})
 
-	return configs, utilerrors.NewAggregate([]error{err, errGroup.Wait()})
+	return configs, utilerrors.NewAggregate(append([]error{err}, fileErrors...))
+}
+
+// loadConcurrently calls load for each of the paths on runtime.GOMAXPROCS(0)
+// workers and returns once paths is closed and all calls returned
+func loadConcurrently(paths <-chan string, load func(path string)) {
+	nWorkers := runtime.GOMAXPROCS(0)
+	var wg sync.WaitGroup
+	wg.Add(nWorkers)
+	for i := 0; i < nWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				load(path)
+			}
+		}()
+	}
+	wg.Wait()
 }
 
 func Config(path, unresolvedPath, registryPath string, resolver server.ResolverClient, info *api.Metadata) (*api.ReleaseBuildConfiguration, error) {
@@ -162,22 +367,31 @@ func Config(path, unresolvedPath, registryPath string, resolver server.ResolverC
 		err = results.ForReason("config_resolver").ForError(err)
 		return configSpec, err
 	}
-	configSpec := api.ReleaseBuildConfiguration{}
-	if err := yaml.UnmarshalStrict([]byte(raw), &configSpec); err != nil {
-		if len(path) > 0 {
-			return nil, fmt.Errorf("invalid configuration in file %s: %w\nvalue:\n%s", path, err, raw)
-		}
-		return nil, fmt.Errorf("invalid configuration: %w\nvalue:\n%s", err, raw)
+	configSpec, err := configFromBytes([]byte(raw), path)
+	if err != nil {
+		return nil, err
 	}
 	if registryPath != "" {
 		refs, chains, workflows, _, _, observers, err := Registry(registryPath, RegistryFlag(0))
 		if err != nil {
 			return nil, fmt.Errorf("failed to load registry: %w", err)
 		}
-		configSpec, err = registry.ResolveConfig(registry.NewResolver(refs, chains, workflows, observers), configSpec)
+		resolved, err := registry.ResolveConfig(registry.NewResolver(refs, chains, workflows, observers), *configSpec)
 		if err != nil {
 			return nil, fmt.Errorf("failed to resolve configuration: %w", err)
 		}
+		configSpec = &resolved
+	}
+	return configSpec, nil
+}
+
+func configFromBytes(raw []byte, path string) (*api.ReleaseBuildConfiguration, error) {
+	configSpec := api.ReleaseBuildConfiguration{}
+	if err := yaml.UnmarshalStrict(raw, &configSpec); err != nil {
+		if len(path) > 0 {
+			return nil, fmt.Errorf("invalid configuration in file %s: %w\nvalue:\n%s", path, err, raw)
+		}
+		return nil, fmt.Errorf("invalid configuration: %w\nvalue:\n%s", err, raw)
 	}
 	return &configSpec, nil
 }
@@ -185,19 +399,275 @@ func Config(path, unresolvedPath, registryPath string, resolver server.ResolverC
 // Registry takes the path to a registry config directory and returns the full set of references, chains,
 // and workflows that the registry's Resolver needs to resolve a user's MultiStageTestConfiguration
 func Registry(root string, flags RegistryFlag) (registry.ReferenceByName, registry.ChainByName, registry.WorkflowByName, map[string]string, api.RegistryMetadata, registry.ObserverByName, error) {
-	flat := flags&RegistryFlat != 0
-	references := registry.ReferenceByName{}
-	chains := registry.ChainByName{}
-	workflows := registry.WorkflowByName{}
-	observers := registry.ObserverByName{}
-	var documentation map[string]string
-	var metadata api.RegistryMetadata
-	if flags&RegistryDocumentation != 0 {
-		documentation = map[string]string{}
+	return RegistryWithOverlay(root, flags, nil)
+}
+
+// RegistryWithOverlay loads the registry like Registry does, preferring the
+// contents in the overlay over the files on disk.
+func RegistryWithOverlay(root string, flags RegistryFlag, overlay Overlay) (registry.ReferenceByName, registry.ChainByName, registry.WorkflowByName, map[string]string, api.RegistryMetadata, registry.ObserverByName, error) {
+	files := NewRegistryFiles(root, flags)
+	if err := files.Load(overlay); err != nil {
+		return nil, nil, nil, nil, nil, nil, err
 	}
-	if flags&RegistryMetadata != 0 {
-		metadata = api.RegistryMetadata{}
+	references, chains, workflows, documentation, metadata, observers := files.Components()
+	return references, chains, workflows, documentation, metadata, observers, nil
+}
+
+// RegistryFiles holds what was loaded from each file of a step registry, so
+// that individual files can be reloaded without walking and parsing the whole
+// registry again.
+type RegistryFiles struct {
+	// roots holds the registries in increasing priority
+	roots []string
+	flags RegistryFlag
+	files map[string]registryFile
+
+	references    registry.ReferenceByName
+	chains        registry.ChainByName
+	workflows     registry.WorkflowByName
+	documentation map[string]string
+	metadata      api.RegistryMetadata
+	observers     registry.ObserverByName
+	paths         map[string]string
+	cache         *ParseCache
+	interner      *Interner
+	// partial determines whether loads use the files that loaded when others
+	// fail to load, recording their errors in fileErrors
+	partial    bool
+	fileErrors map[string]*FileError
+}
+
+// registryFile holds the registry component loaded from a single file
+type registryFile struct {
+	name          string
+	documentation string
+	reference     *api.LiteralTestStep
+	chain         *api.RegistryChain
+	workflow      *api.MultiStageTestConfiguration
+	observer      *api.Observer
+	metadata      *api.RegistryInfo
+	// commands is the path of the commands file of a reference or observer
+	commands string
+}
+
+// NewRegistryFiles returns an empty RegistryFiles for the registry at root
+func NewRegistryFiles(root string, flags RegistryFlag) *RegistryFiles {
+	return NewLayeredRegistryFiles([]string{root}, flags)
+}
+
+// NewLayeredRegistryFiles returns an empty RegistryFiles for the registries at
+// roots, which are merged in increasing priority: components of a registry
+// replace the components with the same name in the registries before it.
+func NewLayeredRegistryFiles(roots []string, flags RegistryFlag) *RegistryFiles {
+	return &RegistryFiles{roots: roots, flags: flags, files: map[string]registryFile{}}
+}
+
+// rootOf returns the index of the registry that path is in
+func (r *RegistryFiles) rootOf(path string) (int, bool) {
+	index, found := 0, false
+	for i, root := range r.roots {
+		// nested registries take precedence over the ones they are in
+		if isUnder(root, path) && (!found || isUnder(r.roots[index], root)) {
+			index, found = i, true
+		}
+	}
+	return index, found
+}
+
+// Components returns the components of the registry as of the last successful load
+func (r *RegistryFiles) Components() (registry.ReferenceByName, registry.ChainByName, registry.WorkflowByName, map[string]string, api.RegistryMetadata, registry.ObserverByName) {
+	return r.references, r.chains, r.workflows, r.documentation, r.metadata, r.observers
+}
+
+// SetCache makes loads reuse the files in cache whose content did not change
+// instead of parsing them again
+func (r *RegistryFiles) SetCache(cache *ParseCache) {
+	r.cache = cache
+}
+
+// SetInterner makes loads deduplicate the strings of the components they parse
+func (r *RegistryFiles) SetInterner(interner *Interner) {
+	r.interner = interner
+}
+
+// SetPartial makes loads use the registry made up of the files that loaded
+// when others fail to load instead of failing. The errors of the files that
+// failed are available from FileErrors. Loads still fail if the registry made
+// up of the other files is not valid.
+func (r *RegistryFiles) SetPartial() {
+	r.partial = true
+}
+
+// FileErrors returns the errors of the files that failed to load in partial
+// loads, sorted by path
+func (r *RegistryFiles) FileErrors() []*FileError {
+	var fileErrors []*FileError
+	for _, fileErr := range r.fileErrors {
+		fileErrors = append(fileErrors, fileErr)
+	}
+	sort.Slice(fileErrors, func(i, j int) bool {
+		return fileErrors[i].Path < fileErrors[j].Path
+	})
+	return fileErrors
+}
+
+// tolerateFileErrors returns the errors of single files in err if loads are
+// partial, and any other errors
+func (r *RegistryFiles) tolerateFileErrors(err error) ([]*FileError, error) {
+	if !r.partial {
+		return nil, err
+	}
+	return FileErrors(err)
+}
+
+// ComponentPaths maps registry components, named by their kind and name like
+// in registry.Provenance, to the files that define them
+func (r *RegistryFiles) ComponentPaths() map[string]string {
+	return r.paths
+}
+
+// Load walks the whole registry and loads every file in it. On error, the
+// previously loaded state is retained. On success, the interner forgets the
+// strings of components that no longer exist.
+func (r *RegistryFiles) Load(overlay Overlay) error {
+	var paths []string
+	for _, root := range r.roots {
+		found, err := walkRegistry(root, overlay)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, found...)
+	}
+	r.cache.prune(r.roots, sets.NewString(paths...))
+	files := map[string]registryFile{}
+	fileErrors, err := r.tolerateFileErrors(r.loadFiles(paths, files, overlay))
+	if err != nil {
+		return err
+	}
+	if err := r.setFiles(files); err != nil {
+		return err
+	}
+	r.fileErrors = map[string]*FileError{}
+	for _, fileErr := range fileErrors {
+		r.fileErrors[fileErr.Path] = fileErr
+	}
+	r.retainStrings()
+	return nil
+}
+
+// retainStrings makes the interner forget the strings of components that no
+// longer exist
+func (r *RegistryFiles) retainStrings() {
+	if r.interner == nil {
+		return
+	}
+	var components []interface{}
+	for _, file := range r.files {
+		components = append(components, file.name, file.reference, file.chain, file.workflow, file.observer, file.metadata)
+	}
+	r.interner.Retain(components...)
+}
+
+// Reload loads the given paths again, which may be files or directories that
+// were added, changed or removed. References and observers whose commands
+// file is among the paths are reloaded as well. Paths that are not under any
+// registry root are ignored. On error, the previously loaded state is retained.
+// On success, the interner forgets the strings of components that no longer
+// exist.
+func (r *RegistryFiles) Reload(paths []string, overlay Overlay) error {
+	files := make(map[string]registryFile, len(r.files))
+	for path, file := range r.files {
+		files[path] = file
+	}
+	fileErrors := make(map[string]*FileError, len(r.fileErrors))
+	for path, fileErr := range r.fileErrors {
+		fileErrors[path] = fileErr
+	}
+	toLoad := sets.NewString()
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		if _, ok := r.rootOf(path); !ok {
+			continue
+		}
+		for existing := range fileErrors {
+			if isUnder(path, existing) {
+				delete(fileErrors, existing)
+			}
+		}
+		for existing, file := range r.files {
+			if isUnder(path, existing) {
+				delete(files, existing)
+			}
+			if file.commands != "" && isUnder(path, file.commands) {
+				toLoad.Insert(existing)
+			}
+		}
+		found, err := walkRegistry(path, overlay)
+		if err != nil {
+			return err
+		}
+		r.cache.prune([]string{path}, sets.NewString(found...))
+		toLoad.Insert(found...)
+	}
+	var existing []string
+	for _, path := range toLoad.List() {
+		if !overlay.exists(path) {
+			delete(files, path)
+			continue
+		}
+		existing = append(existing, path)
 	}
+	foundErrors, err := r.tolerateFileErrors(r.loadFiles(existing, files, overlay))
+	if err != nil {
+		return err
+	}
+	for _, fileErr := range foundErrors {
+		// files reloaded for their commands are still in files
+		delete(files, fileErr.Path)
+		fileErrors[fileErr.Path] = fileErr
+	}
+	if err := r.setFiles(files); err != nil {
+		return err
+	}
+	r.fileErrors = fileErrors
+	r.retainStrings()
+	return nil
+}
+
+// loadFiles loads the files at paths concurrently and adds the components in
+// them to files. The errors of all files are returned, ordered by path.
+func (r *RegistryFiles) loadFiles(paths []string, files map[string]registryFile, overlay Overlay) error {
+	lock := &sync.Mutex{}
+	var fileErrors []error
+	toLoad := make(chan string)
+	go func() {
+		defer close(toLoad)
+		for _, path := range paths {
+			toLoad <- path
+		}
+	}()
+	loadConcurrently(toLoad, func(path string) {
+		file, err := r.loadFile(path, overlay)
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil {
+			fileErrors = append(fileErrors, newFileError(path, err))
+			return
+		}
+		if file != nil {
+			files[path] = *file
+		}
+	})
+	sort.Slice(fileErrors, func(i, j int) bool {
+		return fileErrors[i].(*FileError).Path < fileErrors[j].(*FileError).Path
+	})
+	return utilerrors.NewAggregate(fileErrors)
+}
+
+// walkRegistry returns all files at or below root, including those only in the overlay
+func walkRegistry(root string, overlay Overlay) ([]string, error) {
+	var paths []string
+	seen := sets.NewString()
 	err := filepath.WalkDir(root, func(path string, info fs.DirEntry, err error) error {
 		if info != nil && strings.HasPrefix(info.Name(), "..") {
 			if info.IsDir() {
@@ -213,130 +683,80 @@ func Registry(root string, flags RegistryFlag) (registry.ReferenceByName, regist
 			return err
 		}
 		if info != nil && !info.IsDir() {
-			if filepath.Ext(info.Name()) == ".md" || info.Name() == "OWNERS" {
-				return nil
-			}
-			raw, err := gzip.ReadFileMaybeGZIP(path)
-			if err != nil {
-				return err
-			}
-			dir := filepath.Dir(path)
-			var prefix string
-			if !flat {
-				relpath, err := filepath.Rel(root, path)
-				if err != nil {
-					return fmt.Errorf("failed to determine relative path for %s: %w", path, err)
-				}
-				prefix = strings.ReplaceAll(filepath.Dir(relpath), "/", "-")
-				// Verify that file prefix is correct based on directory path
-				if !strings.HasPrefix(filepath.Base(relpath), prefix) {
-					return fmt.Errorf("file %s has incorrect prefix. Prefix should be %s", path, prefix)
-				}
-			}
-			if strings.HasSuffix(path, RefSuffix) {
-				name, doc, ref, err := loadReference(raw, dir, prefix, flat)
-				if err != nil {
-					return fmt.Errorf("failed to load registry file %s: %w", path, err)
-				}
-				if !flat && name != prefix {
-					return fmt.Errorf("name of reference in file %s should be %s", path, prefix)
-				}
-				if strings.TrimSuffix(filepath.Base(path), RefSuffix) != name {
-					return fmt.Errorf("filename %s does not match name of reference; filename should be %s", filepath.Base(path), fmt.Sprint(prefix, RefSuffix))
-				}
-				references[name] = ref
-				if documentation != nil {
-					documentation[name] = doc
-				}
-			} else if strings.HasSuffix(path, ChainSuffix) {
-				var chain api.RegistryChainConfig
-				err := yaml.UnmarshalStrict(raw, &chain)
-				if err != nil {
-					return fmt.Errorf("failed to load registry file %s: %w", path, err)
-				}
-				if !flat && chain.Chain.As != prefix {
-					return fmt.Errorf("name of chain in file %s should be %s", path, prefix)
-				}
-				if strings.TrimSuffix(filepath.Base(path), ChainSuffix) != chain.Chain.As {
-					return fmt.Errorf("filename %s does not match name of chain; filename should be %s", filepath.Base(path), fmt.Sprint(prefix, ChainSuffix))
-				}
-				if documentation != nil {
-					documentation[chain.Chain.As] = chain.Chain.Documentation
-				}
-				chain.Chain.Documentation = ""
-				chains[chain.Chain.As] = chain.Chain
-			} else if strings.HasSuffix(path, WorkflowSuffix) {
-				name, doc, workflow, err := loadWorkflow(raw)
-				if err != nil {
-					return fmt.Errorf("failed to load registry file %s: %w", path, err)
-				}
-				if !flat && name != prefix {
-					return fmt.Errorf("name of workflow in file %s should be %s", path, prefix)
-				}
-				if strings.TrimSuffix(filepath.Base(path), WorkflowSuffix) != name {
-					return fmt.Errorf("filename %s does not match name of workflow; filename should be %s", filepath.Base(path), fmt.Sprint(prefix, WorkflowSuffix))
-				}
-				workflows[name] = workflow
-				if documentation != nil {
-					documentation[name] = doc
-				}
-			} else if strings.HasSuffix(path, MetadataSuffix) {
-				if metadata == nil {
-					return nil
-				}
-				var data api.RegistryInfo
-				err := json.Unmarshal(raw, &data)
-				if err != nil {
-					return fmt.Errorf("failed to load metadata file %s: %w", path, err)
-				}
-				metadata[filepath.Base(data.Path)] = data
-			} else if strings.HasSuffix(path, ObserverSuffix) {
-				var observer api.RegistryObserverConfig
-				err := yaml.UnmarshalStrict(raw, &observer)
-				if err != nil {
-					return fmt.Errorf("failed to load registry file %s: %w", path, err)
-				}
-				if !flat && observer.Observer.Name != prefix {
-					return fmt.Errorf("name of observer in file %s should be %s", path, prefix)
-				}
-				if strings.TrimSuffix(filepath.Base(path), ObserverSuffix) != observer.Observer.Name {
-					return fmt.Errorf("filename %s does not match name of chain; filename should be %s", filepath.Base(path), fmt.Sprint(prefix, ObserverSuffix))
-				}
-				if !flat && observer.Observer.Commands != fmt.Sprintf("%s%s%s", prefix, CommandsSuffix, filepath.Ext(observer.Observer.Commands)) {
-					return fmt.Errorf("observer %s has invalid command file path; command should be set to %s (with an optional extension like .sh)", observer.Observer.Name, fmt.Sprintf("%s%s", prefix, CommandsSuffix))
-				}
-				command, err := gzip.ReadFileMaybeGZIP(filepath.Join(dir, observer.Observer.Commands))
-				if err != nil {
-					return err
-				}
-				observer.Observer.Commands = string(command)
-				if documentation != nil {
-					documentation[observer.Observer.Name] = observer.Observer.Documentation
-				}
-				observer.Observer.Documentation = ""
-				observers[observer.Observer.Name] = observer.Observer.Observer
-			} else if strings.HasSuffix(path, fmt.Sprintf("%s%s", CommandsSuffix, filepath.Ext(path))) {
-				// ignore
-			} else if filepath.Base(path) == config.ConfigVersionFileName {
-				if version, err := gzip.ReadFileMaybeGZIP(path); err == nil {
-					logrus.WithField("version", string(version)).Info("Resolved configuration version")
-				}
-			} else {
-				return fmt.Errorf("invalid file name: %s", path)
-			}
+			seen.Insert(path)
+			paths = append(paths, path)
 		}
 		return nil
 	})
 	if err != nil {
-		return nil, nil, nil, nil, nil, nil, err
+		return nil, err
+	}
+	return append(paths, overlay.pathsUnder(root, seen)...), nil
+}
+
+// setFiles validates the registry made up of the given files and, if it is
+// valid, replaces the current state with it
+func (r *RegistryFiles) setFiles(files map[string]registryFile) error {
+	references := registry.ReferenceByName{}
+	chains := registry.ChainByName{}
+	workflows := registry.WorkflowByName{}
+	observers := registry.ObserverByName{}
+	paths := map[string]string{}
+	var documentation map[string]string
+	var metadata api.RegistryMetadata
+	if r.flags&RegistryDocumentation != 0 {
+		documentation = map[string]string{}
+	}
+	if r.flags&RegistryMetadata != 0 {
+		metadata = api.RegistryMetadata{}
+	}
+	// add the files of registries with higher priority last so that their
+	// components replace the ones with the same name
+	ordered := make([]string, 0, len(files))
+	for path := range files {
+		ordered = append(ordered, path)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		rootI, _ := r.rootOf(ordered[i])
+		rootJ, _ := r.rootOf(ordered[j])
+		if rootI != rootJ {
+			return rootI < rootJ
+		}
+		return ordered[i] < ordered[j]
+	})
+	for _, path := range ordered {
+		file := files[path]
+		switch {
+		case file.reference != nil:
+			references[file.name] = *file.reference
+			paths["reference/"+file.name] = path
+		case file.chain != nil:
+			chains[file.name] = *file.chain
+			paths["chain/"+file.name] = path
+		case file.workflow != nil:
+			workflows[file.name] = *file.workflow
+			paths["workflow/"+file.name] = path
+		case file.observer != nil:
+			observers[file.name] = *file.observer
+			paths["observer/"+file.name] = path
+		case file.metadata != nil:
+			if metadata != nil {
+				metadata[filepath.Base(file.metadata.Path)] = *file.metadata
+			}
+			continue
+		default:
+			continue
+		}
+		if documentation != nil {
+			documentation[file.name] = file.documentation
+		}
 	}
 	// create graph to verify that there are no cycles
-	if _, err = registry.NewGraph(references, chains, workflows); err != nil {
-		return nil, nil, nil, nil, nil, nil, err
+	if _, err := registry.NewGraph(references, chains, workflows); err != nil {
+		return err
 	}
-	err = registry.Validate(references, chains, workflows, observers)
-	if err != nil {
-		return nil, nil, nil, nil, nil, nil, err
+	if err := registry.Validate(references, chains, workflows, observers); err != nil {
+		return err
 	}
 	// validate the integrity of each reference
 	v := validation.NewValidator()
@@ -347,26 +767,159 @@ func Registry(root string, flags RegistryFlag) (registry.ReferenceByName, regist
 		}
 	}
 	if len(validationErrors) > 0 {
-		return nil, nil, nil, nil, nil, nil, utilerrors.NewAggregate(validationErrors)
+		return utilerrors.NewAggregate(validationErrors)
 	}
-	return references, chains, workflows, documentation, metadata, observers, nil
+	r.files = files
+	r.paths = paths
+	r.references, r.chains, r.workflows, r.documentation, r.metadata, r.observers = references, chains, workflows, documentation, metadata, observers
+	return nil
+}
+
+// loadFile loads the registry component defined in the file at path. Files that
+// do not define a component, like commands, OWNERS or documentation files, are
+// ignored and a nil registryFile is returned.
+func (r *RegistryFiles) loadFile(path string, overlay Overlay) (*registryFile, error) {
+	if filepath.Ext(path) == ".md" || filepath.Base(path) == "OWNERS" {
+		return nil, nil
+	}
+	raw, err := overlay.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return r.cache.registryFile(path, raw, overlay, r.parseAndIntern)
+}
+
+// parseAndIntern parses the file like parseFile does and deduplicates the
+// strings of the component in it
+func (r *RegistryFiles) parseAndIntern(path string, raw []byte, overlay Overlay) (*registryFile, error) {
+	file, err := r.parseFile(path, raw, overlay)
+	if err != nil || file == nil || r.interner == nil {
+		return file, err
+	}
+	file.name = r.interner.String(file.name)
+	for _, component := range []interface{}{file.reference, file.chain, file.workflow, file.observer, file.metadata} {
+		r.interner.Intern(component)
+	}
+	return file, nil
+}
+
+// parseFile parses the registry component defined in the file at path with
+// the content raw
+func (r *RegistryFiles) parseFile(path string, raw []byte, overlay Overlay) (*registryFile, error) {
+	flat := r.flags&RegistryFlat != 0
+	dir := filepath.Dir(path)
+	var prefix string
+	if !flat {
+		index, _ := r.rootOf(path)
+		relpath, err := filepath.Rel(r.roots[index], path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine relative path for %s: %w", path, err)
+		}
+		prefix = strings.ReplaceAll(filepath.Dir(relpath), "/", "-")
+		// Verify that file prefix is correct based on directory path
+		if !strings.HasPrefix(filepath.Base(relpath), prefix) {
+			return nil, fmt.Errorf("file %s has incorrect prefix. Prefix should be %s", path, prefix)
+		}
+	}
+	if strings.HasSuffix(path, RefSuffix) {
+		name, doc, ref, commands, err := loadReference(raw, dir, prefix, flat, overlay)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load registry file %s: %w", path, err)
+		}
+		if !flat && name != prefix {
+			return nil, fmt.Errorf("name of reference in file %s should be %s", path, prefix)
+		}
+		if strings.TrimSuffix(filepath.Base(path), RefSuffix) != name {
+			return nil, fmt.Errorf("filename %s does not match name of reference; filename should be %s", filepath.Base(path), fmt.Sprint(prefix, RefSuffix))
+		}
+		return &registryFile{name: name, documentation: doc, reference: &ref, commands: commands}, nil
+	} else if strings.HasSuffix(path, ChainSuffix) {
+		var chain api.RegistryChainConfig
+		err := yaml.UnmarshalStrict(raw, &chain)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load registry file %s: %w", path, err)
+		}
+		if !flat && chain.Chain.As != prefix {
+			return nil, fmt.Errorf("name of chain in file %s should be %s", path, prefix)
+		}
+		if strings.TrimSuffix(filepath.Base(path), ChainSuffix) != chain.Chain.As {
+			return nil, fmt.Errorf("filename %s does not match name of chain; filename should be %s", filepath.Base(path), fmt.Sprint(prefix, ChainSuffix))
+		}
+		doc := chain.Chain.Documentation
+		chain.Chain.Documentation = ""
+		return &registryFile{name: chain.Chain.As, documentation: doc, chain: &chain.Chain}, nil
+	} else if strings.HasSuffix(path, WorkflowSuffix) {
+		name, doc, workflow, err := loadWorkflow(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load registry file %s: %w", path, err)
+		}
+		if !flat && name != prefix {
+			return nil, fmt.Errorf("name of workflow in file %s should be %s", path, prefix)
+		}
+		if strings.TrimSuffix(filepath.Base(path), WorkflowSuffix) != name {
+			return nil, fmt.Errorf("filename %s does not match name of workflow; filename should be %s", filepath.Base(path), fmt.Sprint(prefix, WorkflowSuffix))
+		}
+		return &registryFile{name: name, documentation: doc, workflow: &workflow}, nil
+	} else if strings.HasSuffix(path, MetadataSuffix) {
+		if r.flags&RegistryMetadata == 0 {
+			return nil, nil
+		}
+		var data api.RegistryInfo
+		err := json.Unmarshal(raw, &data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load metadata file %s: %w", path, err)
+		}
+		return &registryFile{metadata: &data}, nil
+	} else if strings.HasSuffix(path, ObserverSuffix) {
+		var observer api.RegistryObserverConfig
+		err := yaml.UnmarshalStrict(raw, &observer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load registry file %s: %w", path, err)
+		}
+		if !flat && observer.Observer.Name != prefix {
+			return nil, fmt.Errorf("name of observer in file %s should be %s", path, prefix)
+		}
+		if strings.TrimSuffix(filepath.Base(path), ObserverSuffix) != observer.Observer.Name {
+			return nil, fmt.Errorf("filename %s does not match name of chain; filename should be %s", filepath.Base(path), fmt.Sprint(prefix, ObserverSuffix))
+		}
+		if !flat && observer.Observer.Commands != fmt.Sprintf("%s%s%s", prefix, CommandsSuffix, filepath.Ext(observer.Observer.Commands)) {
+			return nil, fmt.Errorf("observer %s has invalid command file path; command should be set to %s (with an optional extension like .sh)", observer.Observer.Name, fmt.Sprintf("%s%s", prefix, CommandsSuffix))
+		}
+		commands := filepath.Join(dir, observer.Observer.Commands)
+		command, err := overlay.ReadFile(commands)
+		if err != nil {
+			return nil, err
+		}
+		observer.Observer.Commands = string(command)
+		doc := observer.Observer.Documentation
+		observer.Observer.Documentation = ""
+		return &registryFile{name: observer.Observer.Name, documentation: doc, observer: &observer.Observer.Observer, commands: commands}, nil
+	} else if strings.HasSuffix(path, fmt.Sprintf("%s%s", CommandsSuffix, filepath.Ext(path))) {
+		// ignore
+	} else if filepath.Base(path) == config.ConfigVersionFileName {
+		logrus.WithField("version", string(raw)).Info("Resolved configuration version")
+	} else {
+		return nil, fmt.Errorf("invalid file name: %s", path)
+	}
+	return nil, nil
 }
 
-func loadReference(bytes []byte, baseDir, prefix string, flat bool) (string, string, api.LiteralTestStep, error) {
+func loadReference(bytes []byte, baseDir, prefix string, flat bool, overlay Overlay) (string, string, api.LiteralTestStep, string, error) {
 	step := api.RegistryReferenceConfig{}
 	err := yaml.UnmarshalStrict(bytes, &step)
 	if err != nil {
-		return "", "", api.LiteralTestStep{}, err
+		return "", "", api.LiteralTestStep{}, "", err
 	}
 	if !flat && step.Reference.Commands != fmt.Sprintf("%s%s%s", prefix, CommandsSuffix, filepath.Ext(step.Reference.Commands)) {
-		return "", "", api.LiteralTestStep{}, fmt.Errorf("reference %s has invalid command file path; command should be set to %s (with an optional extension like .sh)", step.Reference.As, fmt.Sprintf("%s%s", prefix, CommandsSuffix))
+		return "", "", api.LiteralTestStep{}, "", fmt.Errorf("reference %s has invalid command file path; command should be set to %s (with an optional extension like .sh)", step.Reference.As, fmt.Sprintf("%s%s", prefix, CommandsSuffix))
 	}
-	command, err := gzip.ReadFileMaybeGZIP(filepath.Join(baseDir, step.Reference.Commands))
+	commands := filepath.Join(baseDir, step.Reference.Commands)
+	command, err := overlay.ReadFile(commands)
 	if err != nil {
-		return "", "", api.LiteralTestStep{}, err
+		return "", "", api.LiteralTestStep{}, "", err
 	}
 	step.Reference.Commands = string(command)
-	return step.Reference.As, step.Reference.Documentation, step.Reference.LiteralTestStep, nil
+	return step.Reference.As, step.Reference.Documentation, step.Reference.LiteralTestStep, commands, nil
 }
 
 func loadWorkflow(bytes []byte) (string, string, api.MultiStageTestConfiguration, error) {
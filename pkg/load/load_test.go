@@ -3,6 +3,8 @@ package load
 import (
 	"compress/gzip"
 	"encoding/json"
+	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -19,6 +21,7 @@ import (
 
 	"github.com/openshift/ci-tools/pkg/api"
 	"github.com/openshift/ci-tools/pkg/registry"
+	"github.com/openshift/ci-tools/pkg/testhelper"
 	utilgzip "github.com/openshift/ci-tools/pkg/util/gzip"
 )
 
@@ -937,7 +940,7 @@ func TestPartitionByRepo(t *testing.T) {
 	}
 
 	for _, testCase := range testCases {
-		actual, expected := partitionByOrgRepo(testCase.input), testCase.output
+		actual, expected := PartitionByOrgRepo(testCase.input), testCase.output
 		// The output slices are sorted based on the sorting of the input map so
 		// this is more involded than just comparing two maps and ignoring their
 		// order.
@@ -973,3 +976,408 @@ func sortByOrgRepoSlices(in *ByOrgRepo) error {
 
 	return utilerrors.NewAggregate(errs)
 }
+
+func TestFromPathByOrgRepoWithOverlay(t *testing.T) {
+	testNames := func(configs ByOrgRepo) map[string]string {
+		names := map[string]string{}
+		for _, config := range configs["org"]["repo"] {
+			for _, test := range config.Tests {
+				names[config.Metadata.Branch] = test.As
+			}
+		}
+		return names
+	}
+
+	dir := t.TempDir()
+	onDisk := filepath.Join(dir, "org", "repo", "org-repo-master.yaml")
+	if err := os.MkdirAll(filepath.Dir(onDisk), 0755); err != nil {
+		t.Fatalf("failed to create config dir: %v", err)
+	}
+	if err := ioutil.WriteFile(onDisk, testhelper.CIOperatorConfig("org", "repo", "master", "unit"), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	var testCases = []struct {
+		name          string
+		overlay       Overlay
+		expected      map[string]string
+		expectedError bool
+	}{
+		{
+			name:     "no overlay loads the files on disk",
+			expected: map[string]string{"master": "unit"},
+		},
+		{
+			name:     "overlay takes precedence over the file on disk",
+			overlay:  Overlay{onDisk: testhelper.CIOperatorConfig("org", "repo", "master", "lint")},
+			expected: map[string]string{"master": "lint"},
+		},
+		{
+			name: "file only in the overlay is loaded",
+			overlay: Overlay{
+				filepath.Join(dir, "org", "repo", "org-repo-release-4.10.yaml"): testhelper.CIOperatorConfig("org", "repo", "release-4.10", "e2e"),
+			},
+			expected: map[string]string{"master": "unit", "release-4.10": "e2e"},
+		},
+		{
+			name: "overlay outside of the path is ignored",
+			overlay: Overlay{
+				filepath.Join(filepath.Dir(dir), "org-repo-release-4.10.yaml"): testhelper.CIOperatorConfig("org", "repo", "release-4.10", "e2e"),
+			},
+			expected: map[string]string{"master": "unit"},
+		},
+		{
+			name:          "invalid overlay content fails to load",
+			overlay:       Overlay{onDisk: []byte("tests: {")},
+			expectedError: true,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			configs, err := FromPathByOrgRepoWithOverlay(dir, testCase.overlay)
+			if err == nil && testCase.expectedError {
+				t.Fatal("got no error when error was expected")
+			}
+			if err != nil && !testCase.expectedError {
+				t.Fatalf("got error when error wasn't expected: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if diff := cmp.Diff(testCase.expected, testNames(configs)); diff != "" {
+				t.Errorf("did not get expected tests: %s", diff)
+			}
+		})
+	}
+}
+
+func TestRegistryWithOverlay(t *testing.T) {
+	const root = "../../test/multistage-registry/registry"
+	extraRef := `ref:
+  as: ipi-install-extra
+  from: installer
+  commands: ipi-install-extra-commands.sh
+  resources:
+    requests:
+      cpu: 1000m
+      memory: 2Gi
+  documentation: |-
+    An extra step
+`
+	var testCases = []struct {
+		name          string
+		overlay       Overlay
+		expected      map[string]string
+		expectedError bool
+	}{
+		{
+			name: "overlay takes precedence over the commands on disk",
+			overlay: Overlay{
+				filepath.Join(root, "ipi/install/install/ipi-install-install-commands.sh"): []byte("overlay install\n"),
+			},
+			expected: map[string]string{
+				"ipi-deprovision-deprovision": "openshift-cluster destroy\n",
+				"ipi-deprovision-must-gather": "gather\n",
+				"ipi-install-install":         "overlay install\n",
+				"ipi-install-rbac":            "setup-rbac\n",
+			},
+		},
+		{
+			name: "reference only in the overlay is loaded",
+			overlay: Overlay{
+				filepath.Join(root, "ipi/install/extra/ipi-install-extra-ref.yaml"):    []byte(extraRef),
+				filepath.Join(root, "ipi/install/extra/ipi-install-extra-commands.sh"): []byte("extra\n"),
+			},
+			expected: map[string]string{
+				"ipi-deprovision-deprovision": "openshift-cluster destroy\n",
+				"ipi-deprovision-must-gather": "gather\n",
+				"ipi-install-extra":           "extra\n",
+				"ipi-install-install":         "openshift-cluster install\n",
+				"ipi-install-rbac":            "setup-rbac\n",
+			},
+		},
+		{
+			name: "invalid overlay content fails to load",
+			overlay: Overlay{
+				filepath.Join(root, "ipi/install/install/ipi-install-install-ref.yaml"): []byte("ref: {"),
+			},
+			expectedError: true,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			references, _, _, _, _, _, err := RegistryWithOverlay(root, RegistryFlag(0), testCase.overlay)
+			if err == nil && testCase.expectedError {
+				t.Fatal("got no error when error was expected")
+			}
+			if err != nil && !testCase.expectedError {
+				t.Fatalf("got error when error wasn't expected: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			commands := map[string]string{}
+			for name, reference := range references {
+				commands[name] = reference.Commands
+			}
+			if diff := cmp.Diff(testCase.expected, commands); diff != "" {
+				t.Errorf("did not get expected commands: %s", diff)
+			}
+		})
+	}
+}
+
+func TestRegistryFilesReload(t *testing.T) {
+	root := t.TempDir()
+	if err := filepath.WalkDir("../../test/multistage-registry/registry", func(path string, info fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel("../../test/multistage-registry/registry", path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(root, rel), 0755)
+		}
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(root, rel), raw, 0644)
+	}); err != nil {
+		t.Fatalf("failed to copy registry: %v", err)
+	}
+	files := NewRegistryFiles(root, RegistryFlag(0))
+	interner := NewInterner()
+	files.SetInterner(interner)
+	if err := files.Load(nil); err != nil {
+		t.Fatalf("failed to load registry: %v", err)
+	}
+	commands := func() map[string]string {
+		references, _, _, _, _, _ := files.Components()
+		commands := map[string]string{}
+		for name, reference := range references {
+			commands[name] = reference.Commands
+		}
+		return commands
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(root, "ipi/install/install/ipi-install-install-commands.sh"), []byte("changed\n"), 0644); err != nil {
+		t.Fatalf("failed to write commands: %v", err)
+	}
+	if err := files.Reload([]string{filepath.Join(root, "ipi/install/install/ipi-install-install-commands.sh")}, nil); err != nil {
+		t.Fatalf("failed to reload changed commands: %v", err)
+	}
+	expected := map[string]string{
+		"ipi-deprovision-deprovision": "openshift-cluster destroy\n",
+		"ipi-deprovision-must-gather": "gather\n",
+		"ipi-install-install":         "changed\n",
+		"ipi-install-rbac":            "setup-rbac\n",
+	}
+	if diff := cmp.Diff(expected, commands()); diff != "" {
+		t.Errorf("did not get expected commands after changing commands: %s", diff)
+	}
+
+	if err := os.RemoveAll(filepath.Join(root, "ipi/install/rbac")); err != nil {
+		t.Fatalf("failed to remove reference: %v", err)
+	}
+	if err := files.Reload([]string{filepath.Join(root, "ipi/install/rbac")}, nil); err == nil {
+		t.Error("expected removing a reference that is used by a chain to fail")
+	}
+	if diff := cmp.Diff(expected, commands()); diff != "" {
+		t.Errorf("expected failed reload to retain the previous state: %s", diff)
+	}
+
+	if err := os.RemoveAll(filepath.Join(root, "ipi/deprovision")); err != nil {
+		t.Fatalf("failed to remove chain: %v", err)
+	}
+	if err := os.RemoveAll(filepath.Join(root, "ipi/ipi-workflow.yaml")); err != nil {
+		t.Fatalf("failed to remove workflow: %v", err)
+	}
+	if err := os.RemoveAll(filepath.Join(root, "ipi-changed")); err != nil {
+		t.Fatalf("failed to remove workflow: %v", err)
+	}
+	if err := files.Reload([]string{
+		filepath.Join(root, "ipi/deprovision"),
+		filepath.Join(root, "ipi/ipi-workflow.yaml"),
+		filepath.Join(root, "ipi-changed"),
+		filepath.Join(root, "ipi/install/rbac"),
+	}, nil); err == nil {
+		t.Error("expected removing a reference that is used by a chain to fail")
+	}
+	if err := os.MkdirAll(filepath.Join(root, "ipi/install/rbac"), 0755); err != nil {
+		t.Fatalf("failed to recreate reference dir: %v", err)
+	}
+	for name, content := range map[string]string{
+		"ipi-install-rbac-ref.yaml":    "ref:\n  as: ipi-install-rbac\n  from: installer\n  commands: ipi-install-rbac-commands.sh\n  resources:\n    requests:\n      cpu: 1000m\n      memory: 2Gi\n  documentation: rbac\n",
+		"ipi-install-rbac-commands.sh": "setup-rbac\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(root, "ipi/install/rbac", name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to recreate reference: %v", err)
+		}
+	}
+	if err := files.Reload([]string{
+		filepath.Join(root, "ipi/deprovision"),
+		filepath.Join(root, "ipi/ipi-workflow.yaml"),
+		filepath.Join(root, "ipi-changed"),
+		filepath.Join(root, "ipi/install/rbac"),
+	}, nil); err != nil {
+		t.Fatalf("failed to reload removed components: %v", err)
+	}
+	expected = map[string]string{
+		"ipi-install-install": "changed\n",
+		"ipi-install-rbac":    "setup-rbac\n",
+	}
+	if diff := cmp.Diff(expected, commands()); diff != "" {
+		t.Errorf("did not get expected commands after removing components: %s", diff)
+	}
+	if _, ok := interner.lookup("ipi-deprovision-deprovision"); ok {
+		t.Error("expected reloads to make the interner forget the strings of removed components")
+	}
+	if _, ok := interner.lookup("ipi-install-rbac"); !ok {
+		t.Error("expected reloads to keep the strings of existing components")
+	}
+}
+
+func TestConfigsByPathFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"org-repo-master.yaml":  string(testhelper.CIOperatorConfig("org", "repo", "master", "unit")),
+		"org-repo-syntax.yaml":  "tests: []\nbuild_root: image: stream\n",
+		"org-repo-invalid.yaml": "tests: []\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+	}
+
+	configs, err := ConfigsByPath(dir, nil)
+	if err == nil {
+		t.Fatal("expected loading invalid configs to fail")
+	}
+	if _, loaded := configs[filepath.Join(dir, "org-repo-master.yaml")]; !loaded || len(configs) != 1 {
+		t.Errorf("expected only the valid config to be loaded, got %d configs", len(configs))
+	}
+	fileErrors, others := FileErrors(fmt.Errorf("wrapped: %w", err))
+	if others != nil {
+		t.Errorf("expected only errors about files, got %v", others)
+	}
+	type fileError struct {
+		Path string
+		Line int
+	}
+	var actual []fileError
+	for _, fileErr := range fileErrors {
+		actual = append(actual, fileError{Path: fileErr.Path, Line: fileErr.Line})
+	}
+	expected := []fileError{
+		{Path: filepath.Join(dir, "org-repo-invalid.yaml")},
+		{Path: filepath.Join(dir, "org-repo-syntax.yaml"), Line: 2},
+	}
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Errorf("unexpected file errors, diff: %s", diff)
+	}
+}
+
+func TestParseCache(t *testing.T) {
+	type lookups struct {
+		Hits, Misses map[string]int
+	}
+	var actual lookups
+	cache := NewParseCache(func(kind string, hit bool) {
+		if hit {
+			actual.Hits[kind]++
+		} else {
+			actual.Misses[kind]++
+		}
+	})
+	reset := func() {
+		actual = lookups{Hits: map[string]int{}, Misses: map[string]int{}}
+	}
+	config := func(branch string) []byte {
+		return testhelper.CIOperatorConfig("org", "repo", branch, "unit")
+	}
+	dir := t.TempDir()
+	for _, branch := range []string{"master", "release-4.9"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "org-repo-"+branch+".yaml"), config(branch), 0644); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+	}
+	loadConfigs := func() {
+		t.Helper()
+		if _, err := ConfigsByPathWithOptions(dir, nil, ConfigLoadOptions{Cache: cache}); err != nil {
+			t.Fatalf("failed to load configs: %v", err)
+		}
+	}
+
+	reset()
+	loadConfigs()
+	loadConfigs()
+	if diff := cmp.Diff(lookups{Hits: map[string]int{"config": 2}, Misses: map[string]int{"config": 2}}, actual); diff != "" {
+		t.Errorf("expected unchanged configs to be taken from the cache, diff: %s", diff)
+	}
+	reset()
+	if err := ioutil.WriteFile(filepath.Join(dir, "org-repo-master.yaml"), config("main"), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	configs, err := ConfigsByPathWithOptions(dir, nil, ConfigLoadOptions{Cache: cache})
+	if err != nil {
+		t.Fatalf("failed to load configs: %v", err)
+	}
+	if diff := cmp.Diff(lookups{Hits: map[string]int{"config": 1}, Misses: map[string]int{"config": 1}}, actual); diff != "" {
+		t.Errorf("expected only the changed config to be parsed, diff: %s", diff)
+	}
+	if branch := configs[filepath.Join(dir, "org-repo-master.yaml")].Metadata.Branch; branch != "main" {
+		t.Errorf("expected the changed config to be loaded, got branch %q", branch)
+	}
+	// what callers do with cached configs does not change the cache
+	configs[filepath.Join(dir, "org-repo-release-4.9.yaml")].Tests[0].Commands = "modified"
+	configs, err = ConfigsByPathWithOptions(dir, nil, ConfigLoadOptions{Cache: cache})
+	if err != nil {
+		t.Fatalf("failed to load configs: %v", err)
+	}
+	if commands := configs[filepath.Join(dir, "org-repo-release-4.9.yaml")].Tests[0].Commands; commands != "make unit" {
+		t.Errorf("expected modifying a cached config not to change the cache, got commands %q", commands)
+	}
+	if err := os.Remove(filepath.Join(dir, "org-repo-release-4.9.yaml")); err != nil {
+		t.Fatalf("failed to remove config: %v", err)
+	}
+	loadConfigs()
+	if _, cached := cache.configs[filepath.Join(dir, "org-repo-release-4.9.yaml")]; cached || len(cache.configs) != 1 {
+		t.Errorf("expected the removed config to be dropped from the cache, got %d cached configs", len(cache.configs))
+	}
+
+	files := NewRegistryFiles("../../test/multistage-registry/registry", RegistryFlag(0))
+	files.SetCache(cache)
+	if err := files.Load(nil); err != nil {
+		t.Fatalf("failed to load registry: %v", err)
+	}
+	reset()
+	commands := "../../test/multistage-registry/registry/ipi/install/install/ipi-install-install-commands.sh"
+	if err := files.Load(Overlay{commands: []byte("changed\n")}); err != nil {
+		t.Fatalf("failed to load registry: %v", err)
+	}
+	// both the reference and its commands file are parsed again
+	if actual.Misses["registry"] != 2 || actual.Hits["registry"] == 0 {
+		t.Errorf("expected only the reference and its changed commands to be parsed, got %d hits and %d misses", actual.Hits["registry"], actual.Misses["registry"])
+	}
+	references, _, _, _, _, _ := files.Components()
+	if actual := references["ipi-install-install"].Commands; actual != "changed\n" {
+		t.Errorf("expected the changed commands to be loaded, got %q", actual)
+	}
+	// files that only exist in an overlay are dropped once the overlay is gone
+	added := "../../test/multistage-registry/registry/ipi/install/added/ipi-install-added-chain.yaml"
+	if err := files.Reload([]string{added}, Overlay{added: []byte("chain:\n  as: ipi-install-added\n  steps:\n  - ref: ipi-install-install\n  documentation: Added.\n")}); err != nil {
+		t.Fatalf("failed to reload registry: %v", err)
+	}
+	if _, cached := cache.registry[added]; !cached {
+		t.Fatal("expected the added file to be cached")
+	}
+	if err := files.Reload([]string{added}, nil); err != nil {
+		t.Fatalf("failed to reload registry: %v", err)
+	}
+	if _, cached := cache.registry[added]; cached {
+		t.Error("expected the removed file to be dropped from the cache")
+	}
+}
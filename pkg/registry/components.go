@@ -0,0 +1,80 @@
+package registry
+
+import (
+	"fmt"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"github.com/openshift/ci-tools/pkg/api"
+)
+
+// ComponentResolver is a ProvenanceResolver that can also expand chains and
+// workflows on their own, outside of a test
+type ComponentResolver interface {
+	ProvenanceResolver
+	ResolveChain(name string) ([]api.LiteralTestStep, error)
+	ResolveWorkflow(name string) (api.MultiStageTestConfigurationLiteral, error)
+}
+
+func NewComponentResolver(stepsByName ReferenceByName, chainsByName ChainByName, workflowsByName WorkflowByName, observersByName ObserverByName) ComponentResolver {
+	return &registry{
+		stepsByName:     stepsByName,
+		chainsByName:    chainsByName,
+		workflowsByName: workflowsByName,
+		observersByName: observersByName,
+	}
+}
+
+// ResolveChain expands the chain with the given name into the steps it is made
+// of. Parameters that the chain does not set keep the defaults of the steps and
+// are not required to have one.
+func (r *registry) ResolveChain(name string) ([]api.LiteralTestStep, error) {
+	if _, ok := r.chainsByName[name]; !ok {
+		return nil, fmt.Errorf("no chain named %s", name)
+	}
+	steps, errs := r.process([]api.TestStep{{Chain: &name}}, sets.NewString(), stackForChain())
+	if errs != nil {
+		return nil, utilerrors.NewAggregate(errs)
+	}
+	return steps, nil
+}
+
+// ResolveWorkflow expands the workflow with the given name like Resolve does
+// for a test that only uses the workflow. Parameters that the workflow does not
+// set keep the defaults of the steps and are not required to have one.
+func (r *registry) ResolveWorkflow(name string) (api.MultiStageTestConfigurationLiteral, error) {
+	workflow, ok := r.workflowsByName[name]
+	if !ok {
+		return api.MultiStageTestConfigurationLiteral{}, fmt.Errorf("no workflow named %s", name)
+	}
+	resolved := api.MultiStageTestConfigurationLiteral{
+		ClusterProfile:           workflow.ClusterProfile,
+		AllowSkipOnSuccess:       workflow.AllowSkipOnSuccess,
+		AllowBestEffortPostSteps: workflow.AllowBestEffortPostSteps,
+		Leases:                   workflow.Leases,
+		DependencyOverrides:      workflow.DependencyOverrides,
+	}
+	var resolveErrors []error
+	stack := stackForWorkflow(name, workflow.Environment, workflow.Dependencies)
+	for _, phase := range []struct {
+		steps []api.TestStep
+		into  *[]api.LiteralTestStep
+	}{
+		{steps: workflow.Pre, into: &resolved.Pre},
+		{steps: workflow.Test, into: &resolved.Test},
+		{steps: workflow.Post, into: &resolved.Post},
+	} {
+		steps, errs := r.process(phase.steps, sets.NewString(), stack)
+		*phase.into = steps
+		resolveErrors = append(resolveErrors, errs...)
+	}
+	resolveErrors = append(resolveErrors, stack.checkUnused(&stack.records[0])...)
+	observers, errs := r.resolveObservers(append(resolved.Pre, append(resolved.Test, resolved.Post...)...), workflow.Observers)
+	resolved.Observers = observers
+	resolveErrors = append(resolveErrors, errs...)
+	if resolveErrors != nil {
+		return api.MultiStageTestConfigurationLiteral{}, utilerrors.NewAggregate(resolveErrors)
+	}
+	return resolved, nil
+}
@@ -0,0 +1,68 @@
+package registry
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/openshift/ci-tools/pkg/api"
+)
+
+func TestResolveComponents(t *testing.T) {
+	str := func(s string) *string { return &s }
+	references := ReferenceByName{
+		"install":  {As: "install", Environment: []api.StepParameter{{Name: "SIZE"}, {Name: "ZONE", Default: str("a")}}},
+		"teardown": {As: "teardown", Observers: []string{"watcher"}},
+	}
+	chains := ChainByName{
+		"install-chain": {
+			Steps:       []api.TestStep{{Reference: str("install")}},
+			Environment: []api.StepParameter{{Name: "ZONE", Default: str("b")}},
+		},
+	}
+	workflows := WorkflowByName{
+		"ipi": {
+			ClusterProfile: api.ClusterProfileAWS,
+			Pre:            []api.TestStep{{Chain: str("install-chain")}},
+			Post:           []api.TestStep{{Reference: str("teardown")}},
+			Environment:    api.TestEnvironment{"ZONE": "c"},
+		},
+		"broken": {Test: []api.TestStep{{Reference: str("missing")}}},
+	}
+	observers := ObserverByName{"watcher": {Name: "watcher"}}
+	resolver := NewComponentResolver(references, chains, workflows, observers)
+
+	steps, err := resolver.ResolveChain("install-chain")
+	if err != nil {
+		t.Fatalf("failed to resolve chain: %v", err)
+	}
+	// parameters without a default do not have to be set outside of a test
+	expectedSteps := []api.LiteralTestStep{{As: "install", Environment: []api.StepParameter{{Name: "SIZE"}, {Name: "ZONE", Default: str("b")}}}}
+	if diff := cmp.Diff(expectedSteps, steps); diff != "" {
+		t.Errorf("unexpected chain steps, diff: %s", diff)
+	}
+
+	workflow, err := resolver.ResolveWorkflow("ipi")
+	if err != nil {
+		t.Fatalf("failed to resolve workflow: %v", err)
+	}
+	expectedWorkflow := api.MultiStageTestConfigurationLiteral{
+		ClusterProfile: api.ClusterProfileAWS,
+		Pre:            []api.LiteralTestStep{{As: "install", Environment: []api.StepParameter{{Name: "SIZE"}, {Name: "ZONE", Default: str("c")}}}},
+		Post:           []api.LiteralTestStep{{As: "teardown", Observers: []string{"watcher"}}},
+		Observers:      []api.Observer{{Name: "watcher"}},
+	}
+	if diff := cmp.Diff(expectedWorkflow, workflow); diff != "" {
+		t.Errorf("unexpected workflow, diff: %s", diff)
+	}
+
+	for _, resolve := range []func() error{
+		func() error { _, err := resolver.ResolveChain("missing"); return err },
+		func() error { _, err := resolver.ResolveWorkflow("missing"); return err },
+		func() error { _, err := resolver.ResolveWorkflow("broken"); return err },
+	} {
+		if err := resolve(); err == nil {
+			t.Error("expected resolving a missing or broken component to fail")
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"github.com/openshift/ci-tools/pkg/api"
+)
+
+// ConfigDiff describes how the resolved tests of a config differ between two
+// versions of the config, like the one on disk and an edited one. Fields are
+// named like in the serialized resolved config.
+type ConfigDiff struct {
+	// Fields holds the sorted top-level fields other than the tests that differ
+	Fields       []string   `json:"fields,omitempty"`
+	AddedTests   []string   `json:"added_tests,omitempty"`
+	RemovedTests []string   `json:"removed_tests,omitempty"`
+	ChangedTests []TestDiff `json:"changed_tests,omitempty"`
+}
+
+// TestDiff describes how a test that is in both versions of a config differs
+type TestDiff struct {
+	Name string `json:"name"`
+	// Fields holds the sorted fields of the test that differ, other than its
+	// steps. Fields of the resolved multi-stage test are prefixed with
+	// "literal_steps.".
+	Fields []string `json:"fields,omitempty"`
+	// Steps holds the steps that differ, phase by phase
+	Steps []StepDiff `json:"steps,omitempty"`
+	// Reordered holds the phases whose common steps run in a different order
+	Reordered []string `json:"reordered,omitempty"`
+}
+
+// StepChange is how a step differs between two versions of a test
+type StepChange string
+
+const (
+	StepAdded   StepChange = "added"
+	StepRemoved StepChange = "removed"
+	StepChanged StepChange = "changed"
+)
+
+// StepDiff describes how a step of a resolved multi-stage test differs. Steps
+// are matched by their name within their phase.
+type StepDiff struct {
+	// Phase is "pre", "test" or "post"
+	Phase  string     `json:"phase"`
+	Name   string     `json:"name"`
+	Change StepChange `json:"change"`
+	// Fields holds the sorted fields of a changed step that differ
+	Fields []string `json:"fields,omitempty"`
+}
+
+// DiffResolvedConfigs resolves both versions of a config and determines how
+// their resolved tests differ
+func DiffResolvedConfigs(resolver Resolver, before, after api.ReleaseBuildConfiguration) (ConfigDiff, error) {
+	resolvedBefore, err := ResolveConfig(resolver, before)
+	if err != nil {
+		return ConfigDiff{}, fmt.Errorf("failed to resolve the previous config: %w", err)
+	}
+	resolvedAfter, err := ResolveConfig(resolver, after)
+	if err != nil {
+		return ConfigDiff{}, fmt.Errorf("failed to resolve the changed config: %w", err)
+	}
+	return diffResolvedConfigs(resolvedBefore, resolvedAfter)
+}
+
+func diffResolvedConfigs(before, after api.ReleaseBuildConfiguration) (ConfigDiff, error) {
+	var diff ConfigDiff
+	fields, err := diffFields(before, after, "tests")
+	if err != nil {
+		return ConfigDiff{}, err
+	}
+	diff.Fields = fields
+
+	testsBefore, testsAfter := map[string]api.TestStepConfiguration{}, map[string]api.TestStepConfiguration{}
+	for _, test := range before.Tests {
+		testsBefore[test.As] = test
+	}
+	for _, test := range after.Tests {
+		testsAfter[test.As] = test
+	}
+	namesBefore, namesAfter := sets.StringKeySet(testsBefore), sets.StringKeySet(testsAfter)
+	if added := namesAfter.Difference(namesBefore); added.Len() > 0 {
+		diff.AddedTests = added.List()
+	}
+	if removed := namesBefore.Difference(namesAfter); removed.Len() > 0 {
+		diff.RemovedTests = removed.List()
+	}
+	for _, name := range namesBefore.Intersection(namesAfter).List() {
+		testDiff, err := diffTests(testsBefore[name], testsAfter[name])
+		if err != nil {
+			return ConfigDiff{}, fmt.Errorf("failed to compare test %s: %w", name, err)
+		}
+		if len(testDiff.Fields) > 0 || len(testDiff.Steps) > 0 || len(testDiff.Reordered) > 0 {
+			diff.ChangedTests = append(diff.ChangedTests, testDiff)
+		}
+	}
+	return diff, nil
+}
+
+func diffTests(before, after api.TestStepConfiguration) (TestDiff, error) {
+	diff := TestDiff{Name: before.As}
+	fields, err := diffFields(before, after, "literal_steps")
+	if err != nil {
+		return TestDiff{}, err
+	}
+	diff.Fields = fields
+	literalBefore, literalAfter := before.MultiStageTestConfigurationLiteral, after.MultiStageTestConfigurationLiteral
+	switch {
+	case literalBefore == nil && literalAfter == nil:
+		return diff, nil
+	case literalBefore == nil || literalAfter == nil:
+		diff.Fields = append(diff.Fields, "literal_steps")
+		sort.Strings(diff.Fields)
+		return diff, nil
+	}
+	literalFields, err := diffFields(*literalBefore, *literalAfter, "pre", "test", "post")
+	if err != nil {
+		return TestDiff{}, err
+	}
+	for _, field := range literalFields {
+		diff.Fields = append(diff.Fields, "literal_steps."+field)
+	}
+	sort.Strings(diff.Fields)
+	for _, phase := range []struct {
+		name          string
+		before, after []api.LiteralTestStep
+	}{
+		{name: "pre", before: literalBefore.Pre, after: literalAfter.Pre},
+		{name: "test", before: literalBefore.Test, after: literalAfter.Test},
+		{name: "post", before: literalBefore.Post, after: literalAfter.Post},
+	} {
+		steps, reordered, err := diffSteps(phase.name, phase.before, phase.after)
+		if err != nil {
+			return TestDiff{}, err
+		}
+		diff.Steps = append(diff.Steps, steps...)
+		if reordered {
+			diff.Reordered = append(diff.Reordered, phase.name)
+		}
+	}
+	return diff, nil
+}
+
+// diffSteps compares the steps of a phase and determines whether the steps in
+// both versions run in a different order. Steps are matched by their name, so
+// a phase that has several steps with the same name cannot be compared; tests
+// that already have literal steps are not validated when they are resolved.
+func diffSteps(phase string, before, after []api.LiteralTestStep) ([]StepDiff, bool, error) {
+	stepsBefore, stepsAfter := map[string]api.LiteralTestStep{}, map[string]api.LiteralTestStep{}
+	for _, version := range []struct {
+		steps  []api.LiteralTestStep
+		byName map[string]api.LiteralTestStep
+	}{
+		{steps: before, byName: stepsBefore},
+		{steps: after, byName: stepsAfter},
+	} {
+		for _, step := range version.steps {
+			if _, ok := version.byName[step.As]; ok {
+				return nil, false, fmt.Errorf("%s phase has more than one step named %s", phase, step.As)
+			}
+			version.byName[step.As] = step
+		}
+	}
+	var diffs []StepDiff
+	var commonBefore, commonAfter []string
+	for _, step := range before {
+		if _, ok := stepsAfter[step.As]; !ok {
+			diffs = append(diffs, StepDiff{Phase: phase, Name: step.As, Change: StepRemoved})
+			continue
+		}
+		commonBefore = append(commonBefore, step.As)
+		fields, err := diffFields(step, stepsAfter[step.As])
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to compare step %s: %w", step.As, err)
+		}
+		if len(fields) > 0 {
+			diffs = append(diffs, StepDiff{Phase: phase, Name: step.As, Change: StepChanged, Fields: fields})
+		}
+	}
+	for _, step := range after {
+		if _, ok := stepsBefore[step.As]; !ok {
+			diffs = append(diffs, StepDiff{Phase: phase, Name: step.As, Change: StepAdded})
+			continue
+		}
+		commonAfter = append(commonAfter, step.As)
+	}
+	reordered := false
+	for i := range commonBefore {
+		if commonBefore[i] != commonAfter[i] {
+			reordered = true
+			break
+		}
+	}
+	return diffs, reordered, nil
+}
+
+// diffFields returns the sorted top-level fields of the serialized values
+// that differ, except for the ignored ones
+func diffFields(before, after interface{}, ignored ...string) ([]string, error) {
+	fieldsBefore, err := serializedFields(before)
+	if err != nil {
+		return nil, err
+	}
+	fieldsAfter, err := serializedFields(after)
+	if err != nil {
+		return nil, err
+	}
+	skip := sets.NewString(ignored...)
+	var fields []string
+	for _, field := range sets.StringKeySet(fieldsBefore).Union(sets.StringKeySet(fieldsAfter)).List() {
+		if skip.Has(field) {
+			continue
+		}
+		if !bytes.Equal(fieldsBefore[field], fieldsAfter[field]) {
+			fields = append(fields, field)
+		}
+	}
+	return fields, nil
+}
+
+func serializedFields(value interface{}) (map[string]json.RawMessage, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize: %w", err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, fmt.Errorf("failed to deserialize: %w", err)
+	}
+	return fields, nil
+}
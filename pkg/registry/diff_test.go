@@ -0,0 +1,109 @@
+package registry
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/openshift/ci-tools/pkg/api"
+)
+
+func TestDiffResolvedConfigs(t *testing.T) {
+	str := func(s string) *string { return &s }
+	references := ReferenceByName{
+		"install":  {As: "install", From: "installer", Commands: "install", Environment: []api.StepParameter{{Name: "SIZE", Default: str("small")}}},
+		"rbac":     {As: "rbac", From: "installer", Commands: "setup-rbac"},
+		"teardown": {As: "teardown", From: "installer", Commands: "teardown"},
+	}
+	chains := ChainByName{
+		"install-chain": {Steps: []api.TestStep{{Reference: str("rbac")}, {Reference: str("install")}}},
+	}
+	workflows := WorkflowByName{
+		"ipi": {
+			ClusterProfile: api.ClusterProfileAWS,
+			Pre:            []api.TestStep{{Chain: str("install-chain")}},
+			Post:           []api.TestStep{{Reference: str("teardown")}},
+		},
+	}
+	resolver := NewResolver(references, chains, workflows, nil)
+	test := func(name string, configure func(*api.MultiStageTestConfiguration)) api.TestStepConfiguration {
+		config := api.MultiStageTestConfiguration{
+			Workflow: str("ipi"),
+			Test:     []api.TestStep{{LiteralTestStep: &api.LiteralTestStep{As: "e2e", From: "src", Commands: "make e2e"}}},
+		}
+		if configure != nil {
+			configure(&config)
+		}
+		return api.TestStepConfiguration{As: name, MultiStageTestConfiguration: &config}
+	}
+	before := api.ReleaseBuildConfiguration{
+		Tests: []api.TestStepConfiguration{
+			test("e2e", nil),
+			test("e2e-upgrade", nil),
+			{As: "unit", Commands: "make test", ContainerTestConfiguration: &api.ContainerTestConfiguration{From: "src"}},
+		},
+	}
+	after := api.ReleaseBuildConfiguration{
+		Tests: []api.TestStepConfiguration{
+			test("e2e", func(config *api.MultiStageTestConfiguration) {
+				config.Environment = api.TestEnvironment{"SIZE": "large"}
+				config.Pre = []api.TestStep{{Reference: str("install")}, {Reference: str("rbac")}}
+				config.Post = []api.TestStep{{LiteralTestStep: &api.LiteralTestStep{As: "gather", From: "src", Commands: "gather"}}}
+			}),
+			test("e2e-upgrade", func(config *api.MultiStageTestConfiguration) {
+				config.ClusterProfile = api.ClusterProfileGCP
+			}),
+			{As: "unit", Commands: "make unit", ContainerTestConfiguration: &api.ContainerTestConfiguration{From: "src"}},
+			test("e2e-serial", nil),
+		},
+		Images: []api.ProjectDirectoryImageBuildStepConfiguration{{To: "component"}},
+	}
+
+	diff, err := DiffResolvedConfigs(resolver, before, after)
+	if err != nil {
+		t.Fatalf("failed to diff configs: %v", err)
+	}
+	expected := ConfigDiff{
+		Fields:     []string{"images"},
+		AddedTests: []string{"e2e-serial"},
+		ChangedTests: []TestDiff{
+			{
+				Name: "e2e",
+				Steps: []StepDiff{
+					{Phase: "pre", Name: "install", Change: StepChanged, Fields: []string{"env"}},
+					{Phase: "post", Name: "teardown", Change: StepRemoved},
+					{Phase: "post", Name: "gather", Change: StepAdded},
+				},
+				Reordered: []string{"pre"},
+			},
+			{Name: "e2e-upgrade", Fields: []string{"literal_steps.cluster_profile"}},
+			{Name: "unit", Fields: []string{"commands"}},
+		},
+	}
+	if diff := cmp.Diff(expected, diff); diff != "" {
+		t.Errorf("unexpected diff of resolved configs: %s", diff)
+	}
+
+	if _, err := DiffResolvedConfigs(resolver, before, api.ReleaseBuildConfiguration{Tests: []api.TestStepConfiguration{test("e2e", func(config *api.MultiStageTestConfiguration) {
+		config.Workflow = str("missing")
+	})}}); err == nil {
+		t.Error("expected diffing a config that does not resolve to fail")
+	}
+
+	// tests with literal steps are not validated, so they may repeat a step
+	literal := func(pre ...string) api.ReleaseBuildConfiguration {
+		config := api.MultiStageTestConfigurationLiteral{}
+		for _, name := range pre {
+			config.Pre = append(config.Pre, api.LiteralTestStep{As: name, From: "src", Commands: name})
+		}
+		return api.ReleaseBuildConfiguration{Tests: []api.TestStepConfiguration{{As: "e2e", MultiStageTestConfigurationLiteral: &config}}}
+	}
+	for _, versions := range [][2]api.ReleaseBuildConfiguration{
+		{literal("setup", "setup"), literal("setup")},
+		{literal("setup"), literal("setup", "setup")},
+	} {
+		if _, err := DiffResolvedConfigs(resolver, versions[0], versions[1]); err == nil {
+			t.Error("expected diffing a phase with duplicate step names to fail")
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package registry
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"github.com/openshift/ci-tools/pkg/api"
+)
+
+// Provenance maps the fields of a resolved test to the components that set
+// them. Fields are named by their path in the resolved test, like
+// "cluster_profile", "pre[0]" or "test[1].env.SIZE". Components are named by
+// their kind and name, like "test/e2e", "workflow/ipi", "chain/ipi-install",
+// "reference/ipi-install-install" or "observer/resourcewatcher".
+type Provenance map[string]string
+
+// ProvenanceResolver is a Resolver that can also determine which components
+// set the fields of a resolved test
+type ProvenanceResolver interface {
+	Resolver
+	ResolveWithProvenance(name string, config api.MultiStageTestConfiguration) (api.MultiStageTestConfigurationLiteral, Provenance, error)
+}
+
+func NewProvenanceResolver(stepsByName ReferenceByName, chainsByName ChainByName, workflowsByName WorkflowByName, observersByName ObserverByName) ProvenanceResolver {
+	return &registry{
+		stepsByName:     stepsByName,
+		chainsByName:    chainsByName,
+		workflowsByName: workflowsByName,
+		observersByName: observersByName,
+	}
+}
+
+// provenanceRecord holds the parameters and dependencies that a component
+// sets for the steps below it, mirroring a stackRecord
+type provenanceRecord struct {
+	component string
+	env       sets.String
+	deps      sets.String
+}
+
+// ResolveWithProvenance resolves the test like Resolve does and determines
+// which component set each field of the resolved test
+func (r *registry) ResolveWithProvenance(name string, config api.MultiStageTestConfiguration) (api.MultiStageTestConfigurationLiteral, Provenance, error) {
+	// Resolve merges the maps of the workflow into the ones of the test, so
+	// determine what the test sets beforehand
+	testEnv := sets.StringKeySet(config.Environment)
+	testDeps := sets.StringKeySet(config.Dependencies)
+	testOverrides := sets.StringKeySet(config.DependencyOverrides)
+	resolved, err := r.Resolve(name, config)
+	if err != nil {
+		return api.MultiStageTestConfigurationLiteral{}, nil, err
+	}
+	provenance := Provenance{}
+	test := "test/" + name
+	var workflow api.MultiStageTestConfiguration
+	var workflowName string
+	if config.Workflow != nil {
+		workflow = r.workflowsByName[*config.Workflow]
+		workflowName = "workflow/" + *config.Workflow
+	}
+	// pick returns the test if it set the field and the workflow otherwise
+	pick := func(setInTest bool) string {
+		if setInTest || workflowName == "" {
+			return test
+		}
+		return workflowName
+	}
+
+	if resolved.ClusterProfile != "" {
+		provenance["cluster_profile"] = pick(config.ClusterProfile != "")
+	}
+	if resolved.AllowSkipOnSuccess != nil {
+		provenance["allow_skip_on_success"] = pick(config.AllowSkipOnSuccess != nil)
+	}
+	if resolved.AllowBestEffortPostSteps != nil {
+		provenance["allow_best_effort_post_steps"] = pick(config.AllowBestEffortPostSteps != nil)
+	}
+	for key := range resolved.DependencyOverrides {
+		provenance["dependency_overrides."+key] = pick(testOverrides.Has(key))
+	}
+	// leases of the workflow come first, followed by the ones only in the test
+	for i := range resolved.Leases {
+		provenance[fmt.Sprintf("leases[%d]", i)] = pick(i >= len(workflow.Leases))
+	}
+
+	records := []provenanceRecord{{component: test, env: testEnv, deps: testDeps}}
+	if workflowName != "" {
+		records = append(records, provenanceRecord{component: workflowName, env: sets.StringKeySet(workflow.Environment), deps: sets.StringKeySet(workflow.Dependencies)})
+	}
+	for _, phase := range []struct {
+		name             string
+		test, inWorkflow []api.TestStep
+	}{
+		{name: "pre", test: config.Pre, inWorkflow: workflow.Pre},
+		{name: "test", test: config.Test, inWorkflow: workflow.Test},
+		{name: "post", test: config.Post, inWorkflow: workflow.Post},
+	} {
+		steps, owner := phase.test, test
+		if steps == nil {
+			steps, owner = phase.inWorkflow, workflowName
+		}
+		var index int
+		r.stepProvenance(provenance, phase.name, steps, owner, records, &index)
+	}
+
+	for i, observer := range resolved.Observers {
+		provenance[fmt.Sprintf("observers[%d]", i)] = "observer/" + observer.Name
+	}
+	return resolved, provenance, nil
+}
+
+// stepProvenance records the components that set the steps of a phase and
+// their parameters and dependencies. Steps are numbered in the order in which
+// they appear in the resolved phase, continuing from index.
+func (r *registry) stepProvenance(provenance Provenance, phase string, steps []api.TestStep, owner string, records []provenanceRecord, index *int) {
+	for _, step := range steps {
+		if step.Chain != nil {
+			chain := r.chainsByName[*step.Chain]
+			record := provenanceRecord{component: "chain/" + *step.Chain, env: sets.NewString()}
+			for _, parameter := range chain.Environment {
+				record.env.Insert(parameter.Name)
+			}
+			// the records of the outermost components take precedence
+			r.stepProvenance(provenance, phase, chain.Steps, record.component, append(records[:len(records):len(records)], record), index)
+			continue
+		}
+		component := owner
+		var literal api.LiteralTestStep
+		if step.Reference != nil {
+			literal = r.stepsByName[*step.Reference]
+			component = "reference/" + *step.Reference
+		} else if step.LiteralTestStep != nil {
+			literal = *step.LiteralTestStep
+		}
+		field := fmt.Sprintf("%s[%d]", phase, *index)
+		*index++
+		provenance[field] = component
+		for _, parameter := range literal.Environment {
+			provenance[field+".env."+parameter.Name] = component
+			for _, record := range records {
+				if record.env.Has(parameter.Name) {
+					provenance[field+".env."+parameter.Name] = record.component
+					break
+				}
+			}
+		}
+		for _, dependency := range literal.Dependencies {
+			provenance[field+".dependencies."+dependency.Env] = component
+			for _, record := range records {
+				if record.deps.Has(dependency.Env) {
+					provenance[field+".dependencies."+dependency.Env] = record.component
+					break
+				}
+			}
+		}
+	}
+}
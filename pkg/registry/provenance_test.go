@@ -0,0 +1,127 @@
+package registry
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/openshift/ci-tools/pkg/api"
+)
+
+func TestResolveWithProvenance(t *testing.T) {
+	str := func(s string) *string { return &s }
+	yes := true
+	references := ReferenceByName{
+		"install": {
+			As:           "install",
+			Environment:  []api.StepParameter{{Name: "SIZE", Default: str("small")}, {Name: "ZONE", Default: str("a")}, {Name: "REGION", Default: str("us")}},
+			Dependencies: []api.StepDependency{{Name: "installer", Env: "INSTALLER"}},
+		},
+		"teardown": {As: "teardown", Observers: []string{"watcher"}},
+	}
+	chains := ChainByName{
+		"install-chain": {
+			Steps:       []api.TestStep{{Reference: str("install")}},
+			Environment: []api.StepParameter{{Name: "ZONE", Default: str("b")}, {Name: "REGION", Default: str("eu")}},
+		},
+	}
+	workflows := WorkflowByName{
+		"ipi": {
+			ClusterProfile: api.ClusterProfileAWS,
+			Pre:            []api.TestStep{{Chain: str("install-chain")}},
+			Test:           []api.TestStep{{LiteralTestStep: &api.LiteralTestStep{As: "e2e"}}},
+			Post:           []api.TestStep{{Reference: str("teardown")}},
+			Environment:    api.TestEnvironment{"REGION": "ap"},
+			Leases:         []api.StepLease{{ResourceType: "aws-quota-slice", Env: "LEASED_RESOURCE"}},
+		},
+	}
+	observers := ObserverByName{"watcher": {Name: "watcher"}}
+
+	for _, testCase := range []struct {
+		name     string
+		config   api.MultiStageTestConfiguration
+		expected Provenance
+	}{
+		{
+			name:   "everything from the workflow",
+			config: api.MultiStageTestConfiguration{Workflow: str("ipi")},
+			expected: Provenance{
+				"cluster_profile":               "workflow/ipi",
+				"leases[0]":                     "workflow/ipi",
+				"pre[0]":                        "reference/install",
+				"pre[0].env.SIZE":               "reference/install",
+				"pre[0].env.ZONE":               "chain/install-chain",
+				"pre[0].env.REGION":             "workflow/ipi",
+				"pre[0].dependencies.INSTALLER": "reference/install",
+				"test[0]":                       "workflow/ipi",
+				"post[0]":                       "reference/teardown",
+				"observers[0]":                  "observer/watcher",
+			},
+		},
+		{
+			name: "test overrides the workflow",
+			config: api.MultiStageTestConfiguration{
+				Workflow:           str("ipi"),
+				ClusterProfile:     api.ClusterProfileGCP,
+				Test:               []api.TestStep{{LiteralTestStep: &api.LiteralTestStep{As: "custom"}}, {LiteralTestStep: &api.LiteralTestStep{As: "other"}}},
+				Environment:        api.TestEnvironment{"SIZE": "large"},
+				Dependencies:       api.TestDependencies{"INSTALLER": "custom-installer"},
+				Leases:             []api.StepLease{{ResourceType: "other-quota-slice", Env: "OTHER"}},
+				AllowSkipOnSuccess: &yes,
+			},
+			expected: Provenance{
+				"cluster_profile":               "test/e2e",
+				"allow_skip_on_success":         "test/e2e",
+				"leases[0]":                     "workflow/ipi",
+				"leases[1]":                     "test/e2e",
+				"pre[0]":                        "reference/install",
+				"pre[0].env.SIZE":               "test/e2e",
+				"pre[0].env.ZONE":               "chain/install-chain",
+				"pre[0].env.REGION":             "workflow/ipi",
+				"pre[0].dependencies.INSTALLER": "test/e2e",
+				"test[0]":                       "test/e2e",
+				"test[1]":                       "test/e2e",
+				"post[0]":                       "reference/teardown",
+				"observers[0]":                  "observer/watcher",
+			},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			resolver := NewProvenanceResolver(references, chains, workflows, observers)
+			environment := testCase.config.Environment.DeepCopy()
+			resolved, provenance, err := resolver.ResolveWithProvenance("e2e", testCase.config)
+			if err != nil {
+				t.Fatalf("failed to resolve with provenance: %v", err)
+			}
+			// resolving must not merge the workflow into the configuration
+			if diff := cmp.Diff(environment, testCase.config.Environment); diff != "" {
+				t.Errorf("resolving changed the environment of the test, diff: %s", diff)
+			}
+			_, again, err := resolver.ResolveWithProvenance("e2e", testCase.config)
+			if err != nil {
+				t.Fatalf("failed to resolve with provenance again: %v", err)
+			}
+			if diff := cmp.Diff(provenance, again); diff != "" {
+				t.Errorf("resolving the same test twice gave different provenance, diff: %s", diff)
+			}
+			expectedResolved, err := resolver.Resolve("e2e", testCase.config)
+			if err != nil {
+				t.Fatalf("failed to resolve: %v", err)
+			}
+			if diff := cmp.Diff(expectedResolved, resolved); diff != "" {
+				t.Errorf("resolved test differs from Resolve, diff: %s", diff)
+			}
+			if diff := cmp.Diff(testCase.expected, provenance); diff != "" {
+				t.Errorf("unexpected provenance, diff: %s", diff)
+			}
+		})
+	}
+}
+
+func TestResolveWithProvenanceError(t *testing.T) {
+	resolver := NewProvenanceResolver(ReferenceByName{}, ChainByName{}, WorkflowByName{}, ObserverByName{})
+	workflow := "missing"
+	if _, _, err := resolver.ResolveWithProvenance("e2e", api.MultiStageTestConfiguration{Workflow: &workflow}); err == nil {
+		t.Error("expected resolving a test with a missing workflow to fail")
+	}
+}
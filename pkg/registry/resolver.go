@@ -118,26 +118,35 @@ func (r *registry) Resolve(name string, config api.MultiStageTestConfiguration)
 	resolveErrors = append(resolveErrors, errs...)
 	resolveErrors = append(resolveErrors, stack.checkUnused(&stack.records[0])...)
 
+	observers, errs := r.resolveObservers(append(pre, append(test, post...)...), config.Observers)
+	expandedFlow.Observers = observers
+	resolveErrors = append(resolveErrors, errs...)
+	if resolveErrors != nil {
+		return api.MultiStageTestConfigurationLiteral{}, utilerrors.NewAggregate(resolveErrors)
+	}
+	return expandedFlow, nil
+}
+
+// resolveObservers returns the observers that the steps use, adjusted by the
+// observers that the test enables or disables
+func (r *registry) resolveObservers(steps []api.LiteralTestStep, config *api.Observers) ([]api.Observer, []error) {
 	observerNames := sets.NewString()
-	for _, step := range append(pre, append(test, post...)...) {
+	for _, step := range steps {
 		observerNames = observerNames.Union(sets.NewString(step.Observers...))
 	}
-	if config.Observers != nil {
-		observerNames = observerNames.Union(sets.NewString(config.Observers.Enable...)).Delete(config.Observers.Disable...)
+	if config != nil {
+		observerNames = observerNames.Union(sets.NewString(config.Enable...)).Delete(config.Disable...)
 	}
 	var observers []api.Observer
+	var errs []error
 	for _, name := range observerNames.List() {
 		observer, exists := r.observersByName[name]
 		if !exists {
-			resolveErrors = append(resolveErrors, fmt.Errorf("observer %q is referenced but no such observer is configured", name))
+			errs = append(errs, fmt.Errorf("observer %q is referenced but no such observer is configured", name))
 		}
 		observers = append(observers, observer)
 	}
-	expandedFlow.Observers = observers
-	if resolveErrors != nil {
-		return api.MultiStageTestConfigurationLiteral{}, utilerrors.NewAggregate(resolveErrors)
-	}
-	return expandedFlow, nil
+	return observers, errs
 }
 
 // mergeEnvironments joins two environment maps.
@@ -161,22 +170,20 @@ func mergeDependencyOverrides(dst *api.DependencyOverrides, src api.DependencyOv
 	mergeMaps((*map[string]string)(dst), src)
 }
 
+// mergeMaps replaces `dst` with a new map, as it is usually shared with the
+// configuration of the caller, which resolving must not modify.
 func mergeMaps(dst *map[string]string, src map[string]string) {
 	if src == nil {
 		return
 	}
-	if *dst == nil {
-		*dst = make(map[string]string, len(src))
-		for k, v := range src {
-			(*dst)[k] = v
-		}
-		return
-	}
+	merged := make(map[string]string, len(*dst)+len(src))
 	for k, v := range src {
-		if _, ok := (*dst)[k]; !ok {
-			(*dst)[k] = v
-		}
+		merged[k] = v
+	}
+	for k, v := range *dst {
+		merged[k] = v
 	}
+	*dst = merged
 }
 
 // mergeLeases joins two lease lists, checking for duplicates.
@@ -0,0 +1,27 @@
+package testhelper
+
+import "fmt"
+
+// CIOperatorConfig returns a minimal valid ci-operator config for a branch of
+// org/repo, with a single container test that runs `make <test>`
+func CIOperatorConfig(org, repo, branch, test string) []byte {
+	return []byte(fmt.Sprintf(`build_root:
+  image_stream_tag:
+    name: release
+    namespace: openshift
+    tag: golang-1.15
+resources:
+  '*':
+    requests:
+      cpu: 100m
+tests:
+- as: %s
+  commands: make %s
+  container:
+    from: src
+zz_generated_metadata:
+  branch: %s
+  org: %s
+  repo: %s
+`, test, test, branch, org, repo))
+}